@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ipfs/go-ipld-eth-import/lib"
+)
+
+/*
+
+## ACCOUNT SNAPSHOT to FILE
+
+Traverses the entire state trie of a given block, writing every account
+found (nonce, balance, storage root and code hash) into a file, one per
+line, as JSON or CSV. The lines are sorted by the keccak256 hash of the
+address, which is the key of the account in the state trie.
+
+## EXAMPLE USAGE
+
+make account-snapshot-file && \
+./build/bin/account-snapshot-file \
+	--block-number 4371405 \
+	--geth-db-filepath /Users/hj/Documents/data/fast-geth/geth/chaindata \
+	--output /tmp/accounts-4371405.jsonl \
+	--format json
+
+*/
+
+func main() {
+	var (
+		fromBlock   uint64
+		toBlock     uint64
+		blockNumber uint64
+		dbFilePath  string
+		output      string
+		format      string
+		nibble      string
+		stackDir    string
+		resume      bool
+	)
+
+	// Command line options
+	flag.Uint64Var(&fromBlock, "from-block", 0, "Same as --block-number, along with --to-block set to the same number")
+	flag.Uint64Var(&toBlock, "to-block", 0, "Same as --block-number, along with --from-block set to the same number")
+	flag.Uint64Var(&blockNumber, "block-number", 0, "Canonical number of the block whose accounts to export")
+	flag.StringVar(&dbFilePath, "geth-db-filepath", "", "Path to the Go-Ethereum Database")
+	flag.StringVar(&output, "output", "/tmp/accounts.jsonl", "Path to the file to write the accounts to")
+	flag.StringVar(&format, "format", "json", "Format of the lines of the file: json or csv")
+	flag.StringVar(&nibble, "nibble", "",
+		"If set, only traverses the state trie paths starting with these comma separated hex prefixes or ranges of them (ex: 2,a0-a7)")
+	flag.StringVar(&stackDir, "stack-dir", "/tmp/trie_stack_data_dir", "Path to the directory to keep the traversal stack")
+	flag.BoolVar(&resume, "resume", false, "Resume the interrupted traversal of the same block, writing the output from its last checkpoint")
+	flag.Parse()
+
+	// Param check. A single block is given by --block-number,
+	// or by --from-block and --to-block set to the same number
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	if setFlags["from-block"] || setFlags["to-block"] {
+		if setFlags["block-number"] || fromBlock != toBlock {
+			fmt.Printf("ERROR: Only a single block is supported, given by '--block-number', or '--from-block' and '--to-block' set to the same number. Exiting")
+			os.Exit(1)
+		}
+		blockNumber = fromBlock
+	}
+	if format != "json" && format != "csv" {
+		fmt.Printf("ERROR: Param '--format' only supports json and csv. Exiting")
+		os.Exit(1)
+	}
+
+	// Cold Database
+	db, err := lib.GethDBInit(dbFilePath)
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		os.Exit(1)
+	}
+	defer db.Stop()
+
+	// Init the synchronization stack
+	cfg := &lib.TrieStackConfig{
+		FromBlock:      blockNumber,
+		ToBlock:        blockNumber,
+		Step:           1,
+		Nibble:         nibble,
+		Operation:      "accounts",
+		StackDir:       stackDir,
+		Resume:         resume,
+		Snapshot:       output,
+		SnapshotFormat: format,
+	}
+	ts, err := lib.NewTrieStack(db, cfg)
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		db.Stop()
+		os.Exit(1)
+	}
+	defer ts.Close()
+
+	// Ctrl-C stops the traversal, keeping it to be resumed
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		ts.Stop()
+	}()
+
+	// Launch Synchronization
+	err = ts.TraverseStateTrie()
+
+	// Print the metrics
+	printReport()
+
+	if err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		fmt.Println("Run it again with --resume to continue from the failed node")
+		ts.Close()
+		db.Stop()
+		os.Exit(1)
+	}
+	if ts.Interrupted() {
+		fmt.Println("Traversal interrupted. Run it again with --resume to continue")
+	}
+}
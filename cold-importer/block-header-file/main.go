@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ipfs/go-ipld-eth-import/lib"
+)
+
+/*
+
+## BLOCK HEADERS to FILE
+
+Walks a range of canonical block numbers, fetching their block headers,
+dumping their RLP in a file, with its keccak256 hash (i.e. the block hash)
+as a name.
+
+## EXAMPLE USAGE
+
+make block-header-file && \
+./build/bin/block-header-file \
+	--from-block 4371400 \
+	--to-block 4371405 \
+	--geth-db-filepath /Users/hj/Documents/data/fast-geth/geth/chaindata \
+	--dump-directory /tmp/block-header
+
+*/
+
+func main() {
+	var (
+		fromBlock  uint64
+		toBlock    uint64
+		dbFilePath string
+		dumpDir    string
+	)
+
+	// Command line options
+	flag.Uint64Var(&fromBlock, "from-block", 0, "Canonical number of the first block header to import")
+	flag.Uint64Var(&toBlock, "to-block", 0, "Canonical number of the last block header to import")
+	flag.StringVar(&dbFilePath, "geth-db-filepath", "", "Path to the Go-Ethereum Database")
+	flag.StringVar(&dumpDir, "dump-directory", "/tmp/block-header", "Path to the directory to dump the files")
+	flag.Parse()
+
+	// Cold Database
+	db, err := lib.GethDBInit(dbFilePath)
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		os.Exit(1)
+	}
+	defer db.Stop()
+
+	// Init the block walker
+	bw, err := lib.NewBlockWalker(db, fromBlock, toBlock, dumpDir, "block-header")
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		db.Stop()
+		os.Exit(1)
+	}
+
+	// Launch Synchronization
+	err = bw.TraverseBlocks()
+
+	// Print the metrics
+	printReport()
+
+	if err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		db.Stop()
+		os.Exit(1)
+	}
+}
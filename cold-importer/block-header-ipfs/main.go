@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ipfs/go-ipld-eth-import/lib"
+)
+
+/*
+
+## BLOCK HEADERS IPFS
+
+Takes the block header files dumped from the geth database
+and imports them to IPFS as `eth-block` objects.
+
+## EXAMPLE USAGE
+
+make block-header-ipfs && ./build/bin/block-header-ipfs --ipfs-repo-path ~/.ipfs
+
+*/
+
+func main() {
+	var (
+		blockHeaderDir string
+		ipfsRepoPath   string
+		prefix         string
+	)
+
+	// Command line options
+	flag.StringVar(&blockHeaderDir, "block-header-directory", "/tmp/block-header", "Directory where the block header files are")
+	flag.StringVar(&ipfsRepoPath, "ipfs-repo-path", "~/.ipfs", "IPFS repository path")
+	flag.StringVar(&prefix, "prefix", "", "If set, will only process the files which name starts with <prefix>. Only two characters supported")
+	flag.Parse()
+
+	// Param check
+	if prefix != "" && len(prefix) != 2 {
+		fmt.Printf("ERROR: Param '--prefix' only supports two characters. Exiting")
+		os.Exit(1)
+	}
+
+	// IPFS
+	ipfs, err := lib.InitIPFSNode(ipfsRepoPath)
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		os.Exit(1)
+	}
+
+	// Launch the main loop
+	walker, err := lib.InitWalker(ipfs, blockHeaderDir, prefix, "eth-block")
+	if err == nil {
+		err = walker.TraverseDirectory()
+	}
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		os.Exit(1)
+	}
+
+	// Print the metrics
+	printReport()
+}
@@ -40,11 +40,21 @@ func main() {
 	}
 
 	// IPFS
-	ipfs := lib.InitIPFSNode(ipfsRepoPath)
+	ipfs, err := lib.InitIPFSNode(ipfsRepoPath)
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		os.Exit(1)
+	}
 
 	// Launch the main loop
-	walker := lib.InitWalker(ipfs, evmcodeDir, prefix)
-	walker.TraverseDirectory()
+	walker, err := lib.InitWalker(ipfs, evmcodeDir, prefix, "importer-ipld-raw-data")
+	if err == nil {
+		err = walker.TraverseDirectory()
+	}
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		os.Exit(1)
+	}
 
 	// Print the metrics
 	printReport()
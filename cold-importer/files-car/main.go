@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ipfs/go-ipld-eth-import/lib"
+)
+
+/*
+
+## FILES to CAR FILE
+
+Takes the files dumped from the geth database (i.e. block headers and
+transactions) and writes them as IPLD blocks into a CARv1 file, instead
+of importing them into IPFS. Every directory is given with the format of
+its files. The root of the file is the block of the given hash, i.e. the
+block header of a block, which must be found in one of the directories.
+
+## EXAMPLE USAGE
+
+make files-car && \
+./build/bin/files-car \
+	--directory /tmp/block-header,/tmp/tx \
+	--format eth-block,eth-tx \
+	--root $BLOCK_HASH \
+	--output /tmp/block.car
+
+*/
+
+func main() {
+	var (
+		directories string
+		formats     string
+		root        string
+		rootFormat  string
+		output      string
+		prefix      string
+	)
+
+	// Command line options
+	flag.StringVar(&directories, "directory", "/tmp/block-header", "Directories where the files are, separated by commas")
+	flag.StringVar(&formats, "format", "eth-block", "IPLD format of the files of every directory (i.e. eth-block, eth-tx, eth-state-trie), separated by commas")
+	flag.StringVar(&root, "root", "", "Hash of the block to set as the root of the CAR file, i.e. a block header")
+	flag.StringVar(&rootFormat, "root-format", "eth-block", "IPLD format of the root block")
+	flag.StringVar(&output, "output", "/tmp/export.car", "Path to the CAR file to write the blocks to")
+	flag.StringVar(&prefix, "prefix", "", "If set, will only process the files which name starts with <prefix>. Only two characters supported")
+	flag.Parse()
+
+	// Param check
+	if prefix != "" && len(prefix) != 2 {
+		fmt.Printf("ERROR: Param '--prefix' only supports two characters. Exiting")
+		os.Exit(1)
+	}
+	rootHash, err := hex.DecodeString(strings.TrimPrefix(root, "0x"))
+	if err != nil || len(rootHash) != 32 {
+		fmt.Printf("ERROR: Param '--root' must be a hash of 32 bytes. Exiting")
+		os.Exit(1)
+	}
+	dirList := strings.Split(directories, ",")
+	formatList := strings.Split(formats, ",")
+	if len(formatList) != len(dirList) {
+		fmt.Printf("ERROR: Param '--format' must give a format for every directory. Exiting")
+		os.Exit(1)
+	}
+
+	// The CAR file
+	sink, err := lib.NewCARSink(output, rootFormat, rootHash, false)
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		os.Exit(1)
+	}
+
+	// Launch the main loop, once per directory.
+	// The storage trie nodes have a subdirectory per account.
+	for idx, directory := range dirList {
+		var walker *lib.Walker
+		walker, err = lib.InitSinkWalker(sink, directory, prefix, formatList[idx])
+		if err == nil && formatList[idx] == "eth-storage-trie" {
+			err = walker.TraverseAccountDirectories()
+		} else if err == nil {
+			err = walker.TraverseDirectory()
+		}
+		if err != nil {
+			break
+		}
+	}
+	if cerr := sink.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && !sink.RootWritten() {
+		err = fmt.Errorf("the root block %x is not in the directories", rootHash)
+	}
+	if err != nil {
+		os.Remove(output)
+		os.Remove(output + ".size")
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		os.Exit(1)
+	}
+	os.Remove(output + ".size")
+
+	// Print the metrics
+	printReport()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ipfs/go-ipld-eth-import/lib"
+)
+
+/*
+
+## STATE TRIE NODES to CAR FILE
+
+Traverses the entire state trie of a given block, writing the found
+nodes as `eth-state-trie` IPLD blocks into a CARv1 file, with the state
+root as its root. The file can be imported anywhere, without go-ipfs.
+
+## EXAMPLE USAGE
+
+make state-trie-car && \
+./build/bin/state-trie-car \
+	--block-number 4371405 \
+	--geth-db-filepath /Users/hj/Documents/data/fast-geth/geth/chaindata \
+	--output /tmp/state-trie-4371405.car
+
+*/
+
+func main() {
+	var (
+		fromBlock   uint64
+		toBlock     uint64
+		blockNumber uint64
+		dbFilePath  string
+		output      string
+		nibble      string
+		stackDir    string
+		resume      bool
+		pathsIndex  string
+	)
+
+	// Command line options
+	flag.Uint64Var(&fromBlock, "from-block", 0, "Same as --block-number, along with --to-block set to the same number")
+	flag.Uint64Var(&toBlock, "to-block", 0, "Same as --block-number, along with --from-block set to the same number")
+	flag.Uint64Var(&blockNumber, "block-number", 0, "Canonical number of the block whose state to export")
+	flag.StringVar(&dbFilePath, "geth-db-filepath", "", "Path to the Go-Ethereum Database")
+	flag.StringVar(&output, "output", "/tmp/state-trie.car", "Path to the CAR file to write the nodes to")
+	flag.StringVar(&nibble, "nibble", "",
+		"If set, only traverses the state trie paths starting with these comma separated hex prefixes or ranges of them (ex: 2,a0-a7)")
+	flag.StringVar(&stackDir, "stack-dir", "/tmp/trie_stack_data_dir", "Path to the directory to keep the traversal stack")
+	flag.BoolVar(&resume, "resume", false, "Resume the interrupted traversal of the same block, appending to the output")
+	flag.StringVar(&pathsIndex, "paths-index", "", "If set, writes the trie and path of every exported node to this file")
+	flag.Parse()
+
+	// Param check. A single block is given by --block-number,
+	// or by --from-block and --to-block set to the same number
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	if setFlags["from-block"] || setFlags["to-block"] {
+		if setFlags["block-number"] || fromBlock != toBlock {
+			fmt.Printf("ERROR: Only a single block is supported, given by '--block-number', or '--from-block' and '--to-block' set to the same number. Exiting")
+			os.Exit(1)
+		}
+		blockNumber = fromBlock
+	}
+
+	// Cold Database
+	db, err := lib.GethDBInit(dbFilePath)
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		os.Exit(1)
+	}
+	defer db.Stop()
+
+	// Where the nodes go, with the state root as the root of the file.
+	// It is not touched until the traversal below, having locked its
+	// stack directory, writes into it, so a second run of the same
+	// export fails without truncating the file of the first one.
+	var sink *lib.CARSink
+	stateRoot, err := db.GetStateRoot(blockNumber)
+	if err == nil {
+		sink, err = lib.NewCARSink(output, "eth-state-trie", stateRoot, resume)
+	}
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		db.Stop()
+		os.Exit(1)
+	}
+
+	// Init the synchronization stack
+	cfg := &lib.TrieStackConfig{
+		FromBlock:  blockNumber,
+		ToBlock:    blockNumber,
+		Step:       1,
+		Nibble:     nibble,
+		Operation:  "state-trie",
+		Sink:       sink,
+		StackDir:   stackDir,
+		Resume:     resume,
+		PathsIndex: pathsIndex,
+	}
+	ts, err := lib.NewTrieStack(db, cfg)
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		sink.Close()
+		db.Stop()
+		os.Exit(1)
+	}
+	defer ts.Close()
+
+	// Ctrl-C stops the traversal, keeping it to be resumed
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		ts.Stop()
+	}()
+
+	// Launch Synchronization
+	err = ts.TraverseStateTrie()
+
+	// Print the metrics
+	printReport()
+
+	if err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		fmt.Println("Run it again with --resume to continue from the failed node")
+		ts.Close()
+		sink.Close()
+		db.Stop()
+		os.Exit(1)
+	}
+	if ts.Interrupted() {
+		sink.Close()
+		fmt.Println("Traversal interrupted. Run it again with --resume to continue")
+		return
+	}
+
+	// A resumed export only knows about the blocks written since then
+	err = sink.Close()
+	if err == nil && !resume && !sink.RootWritten() {
+		err = fmt.Errorf("the state root %x was not written", stateRoot)
+	}
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		ts.Close()
+		db.Stop()
+		os.Exit(1)
+	}
+	os.Remove(output + ".size")
+}
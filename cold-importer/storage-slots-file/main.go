@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ipfs/go-ipld-eth-import/lib"
+)
+
+/*
+
+## STORAGE SLOTS to FILE
+
+Finds the given contracts in the state trie of a block, and follows their
+storage roots, writing every slot of their storage tries into a file, one
+per line, as JSON or CSV. Every line has the hash of the contract address,
+the keccak256 hash of the slot, the slot itself, when its preimage is found
+in the database, and the RLP decoded value. If any of the contracts is
+not in the state trie, their hashes are printed, and it exits with an error.
+
+## EXAMPLE USAGE
+
+make storage-slots-file && \
+./build/bin/storage-slots-file \
+	--block-number 4371405 \
+	--geth-db-filepath /Users/hj/Documents/data/fast-geth/geth/chaindata \
+	--contracts 0xd26114cd6ee289accf82350c8d8487fedb8a0c07,0x86fa049857e0209aa7d9e616f7eb3b3b78ecfdb0 \
+	--output /tmp/slots-4371405.jsonl \
+	--format json
+
+*/
+
+func main() {
+	var (
+		fromBlock     uint64
+		toBlock       uint64
+		blockNumber   uint64
+		dbFilePath    string
+		contracts     string
+		contractsFile string
+		output        string
+		format        string
+		stackDir      string
+		resume        bool
+	)
+
+	// Command line options
+	flag.Uint64Var(&fromBlock, "from-block", 0, "Same as --block-number, along with --to-block set to the same number")
+	flag.Uint64Var(&toBlock, "to-block", 0, "Same as --block-number, along with --from-block set to the same number")
+	flag.Uint64Var(&blockNumber, "block-number", 0, "Canonical number of the block whose storage slots to export")
+	flag.StringVar(&dbFilePath, "geth-db-filepath", "", "Path to the Go-Ethereum Database")
+	flag.StringVar(&contracts, "contracts", "", "Comma separated addresses of the contracts, or hashes of them")
+	flag.StringVar(&contractsFile, "contracts-file", "", "Path to a file with the addresses of the contracts, or hashes of them, one per line")
+	flag.StringVar(&output, "output", "/tmp/storage-slots.jsonl", "Path to the file to write the storage slots to")
+	flag.StringVar(&format, "format", "json", "Format of the lines of the file: json or csv")
+	flag.StringVar(&stackDir, "stack-dir", "/tmp/trie_stack_data_dir", "Path to the directory to keep the traversal stack")
+	flag.BoolVar(&resume, "resume", false, "Resume the interrupted traversal of the same block, writing the output from its last checkpoint")
+	flag.Parse()
+
+	// Param check. A single block is given by --block-number,
+	// or by --from-block and --to-block set to the same number
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	if setFlags["from-block"] || setFlags["to-block"] {
+		if setFlags["block-number"] || fromBlock != toBlock {
+			fmt.Printf("ERROR: Only a single block is supported, given by '--block-number', or '--from-block' and '--to-block' set to the same number. Exiting")
+			os.Exit(1)
+		}
+		blockNumber = fromBlock
+	}
+	if format != "json" && format != "csv" {
+		fmt.Printf("ERROR: Param '--format' only supports json and csv. Exiting")
+		os.Exit(1)
+	}
+	accounts, err := parseContracts(contracts, contractsFile)
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		os.Exit(1)
+	}
+	if len(accounts) == 0 {
+		fmt.Printf("ERROR: Either '--contracts' or '--contracts-file' is needed. Exiting")
+		os.Exit(1)
+	}
+
+	// Cold Database
+	db, err := lib.GethDBInit(dbFilePath)
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		os.Exit(1)
+	}
+	defer db.Stop()
+
+	// Init the synchronization stack
+	cfg := &lib.TrieStackConfig{
+		FromBlock:      blockNumber,
+		ToBlock:        blockNumber,
+		Step:           1,
+		Operation:      "storage-slots",
+		StackDir:       stackDir,
+		Resume:         resume,
+		Snapshot:       output,
+		SnapshotFormat: format,
+		Accounts:       accounts,
+	}
+	ts, err := lib.NewTrieStack(db, cfg)
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		db.Stop()
+		os.Exit(1)
+	}
+	defer ts.Close()
+
+	// Ctrl-C stops the traversal, keeping it to be resumed
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		ts.Stop()
+	}()
+
+	// Launch Synchronization
+	err = ts.TraverseStateTrie()
+
+	// Print the metrics
+	printReport()
+
+	if err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		fmt.Println("Run it again with --resume to continue from the failed node")
+		ts.Close()
+		db.Stop()
+		os.Exit(1)
+	}
+	if ts.Interrupted() {
+		fmt.Println("Traversal interrupted. Run it again with --resume to continue")
+		return
+	}
+
+	// The slots of the contracts found are written, but
+	// we fail if any of them is not in the state trie
+	missing := ts.MissingAccounts()
+	for _, account := range missing {
+		fmt.Printf("Contract not found in the state trie: %x\n", account)
+	}
+	if len(missing) > 0 {
+		fmt.Printf("ERROR: %d contracts were not found in the state trie of block %d. Exiting\n", len(missing), blockNumber)
+		ts.Close()
+		db.Stop()
+		os.Exit(1)
+	}
+}
+
+// parseContracts returns the keys in the state trie of the contracts
+// given in the command line and in the contracts file, if any.
+func parseContracts(contracts, contractsFile string) ([][]byte, error) {
+	list := strings.Split(contracts, ",")
+
+	if contractsFile != "" {
+		f, err := os.Open(contractsFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			list = append(list, scanner.Text())
+		}
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var accounts [][]byte
+	for _, contract := range list {
+		contract = strings.TrimPrefix(strings.TrimSpace(contract), "0x")
+		if contract == "" {
+			continue
+		}
+
+		b, err := hex.DecodeString(contract)
+		if err != nil {
+			return nil, fmt.Errorf("wrong contract %s: %v", contract, err)
+		}
+
+		// Addresses are 20 bytes, their hashes, the keys of the trie, are 32
+		switch len(b) {
+		case 20:
+			accounts = append(accounts, crypto.Keccak256(b))
+		case 32:
+			accounts = append(accounts, b)
+		default:
+			return nil, fmt.Errorf("wrong contract %s: neither an address nor a hash", contract)
+		}
+	}
+
+	return accounts, nil
+}
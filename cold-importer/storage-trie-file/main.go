@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ipfs/go-ipld-eth-import/lib"
+)
+
+/*
+
+## STORAGE TRIE NODES to FILE
+
+Traverses the entire state trie of a given block. Whenever it finds an
+account with a non empty storage trie, it traverses it, storing its nodes
+into files, under a directory named after the hash of the account.
+
+## EXAMPLE USAGE
+
+./build/bin/storage-trie-file \
+	--from-block 4371405 \
+	--to-block 4371405 \
+	--geth-db-filepath /Users/hj/Documents/data/fast-geth/geth/chaindata \
+	--dump-directory /tmp/storage-trie \
+	--nibble 2
+
+*/
+
+func main() {
+	var (
+		fromBlock    uint64
+		toBlock      uint64
+		blockNumber  uint64
+		step         uint64
+		dbFilePath   string
+		dumpDir      string
+		nibble       string
+		stackDir     string
+		resume       bool
+		workers      int
+		shardNibbles int
+		pathsIndex   string
+	)
+
+	// Command line options
+	flag.Uint64Var(&fromBlock, "from-block", 0, "Canonical number of the first block state to import")
+	flag.Uint64Var(&toBlock, "to-block", 0, "Canonical number of the last block state to import")
+	flag.Uint64Var(&blockNumber, "block-number", 0, "Canonical number of a single block state to import, as --from-block and --to-block set to it")
+	flag.Uint64Var(&step, "step", 1, "Import the state of every <step> blocks of the range")
+	flag.StringVar(&dbFilePath, "geth-db-filepath", "", "Path to the Go-Ethereum Database")
+	flag.StringVar(&dumpDir, "dump-directory", "/tmp/storage-trie", "Path to the directory to create the files to be dumped")
+	flag.StringVar(&nibble, "nibble", "",
+		"If set, only traverses the state trie paths starting with these comma separated hex prefixes or ranges of them (ex: 2,a0-a7)")
+	flag.StringVar(&stackDir, "stack-dir", "/tmp/trie_stack_data_dir", "Path to the directory to keep the traversal stack")
+	flag.BoolVar(&resume, "resume", false, "Resume the interrupted traversal of the same range")
+	flag.IntVar(&workers, "workers", 1, "If greater than one, traverses the shards of the state trie in parallel with this number of workers")
+	flag.IntVar(&shardNibbles, "shard-nibbles", 1, "Number of nibbles (1 or 2) of the path prefixes the state trie is sharded by for --workers")
+	flag.StringVar(&pathsIndex, "paths-index", "", "If set, writes the trie and path of every exported node to this file")
+	flag.Parse()
+
+	// Param check. --block-number is a shorthand for a range of one block
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	if setFlags["block-number"] {
+		if setFlags["from-block"] || setFlags["to-block"] {
+			fmt.Printf("ERROR: Param '--block-number' can not be used along with '--from-block' and '--to-block'. Exiting")
+			os.Exit(1)
+		}
+		fromBlock, toBlock = blockNumber, blockNumber
+	}
+	if workers > 1 && nibble != "" {
+		fmt.Printf("ERROR: Params '--workers' and '--nibble' can not be used together. Exiting")
+		os.Exit(1)
+	}
+
+	// Cold Database
+	db, err := lib.GethDBInit(dbFilePath)
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		os.Exit(1)
+	}
+	defer db.Stop()
+
+	// Where the nodes go
+	sink := lib.NewFileSink(dumpDir)
+	defer sink.Close()
+
+	// Init the synchronization stack, or a pool of them
+	cfg := &lib.TrieStackConfig{
+		FromBlock:  fromBlock,
+		ToBlock:    toBlock,
+		Step:       step,
+		Nibble:     nibble,
+		Operation:  "storage-trie",
+		Sink:       sink,
+		StackDir:   stackDir,
+		Resume:     resume,
+		PathsIndex: pathsIndex,
+	}
+	var ts lib.Traverser
+	if workers > 1 {
+		ts, err = lib.NewTriePool(db, cfg, workers, shardNibbles)
+	} else {
+		ts, err = lib.NewTrieStack(db, cfg)
+	}
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		sink.Close()
+		db.Stop()
+		os.Exit(1)
+	}
+	defer ts.Close()
+
+	// Ctrl-C stops the traversal, keeping it to be resumed
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		ts.Stop()
+	}()
+
+	// Launch Synchronization
+	err = ts.TraverseStateTrie()
+
+	// Print the metrics
+	printReport()
+
+	if err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		fmt.Println("Run it again with --resume to continue from the failed node")
+		ts.Close()
+		sink.Close()
+		db.Stop()
+		os.Exit(1)
+	}
+	if ts.Interrupted() {
+		fmt.Println("Traversal interrupted. Run it again with --resume to continue")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ipfs/go-ipld-eth-import/lib"
+)
+
+/*
+
+## STORAGE TRIE NODES IPFS
+
+Takes the storage trie nodes dumped from the geth database by
+storage-trie-file, in a subdirectory per account, and imports
+them to IPFS
+
+## EXAMPLE USAGE
+
+make storage-trie-ipfs && ./build/bin/storage-trie-ipfs --ipfs-repo-path ~/.ipfs
+
+*/
+
+func main() {
+	var (
+		storageTrieDir string
+		ipfsRepoPath   string
+		prefix         string
+	)
+
+	// Command line options
+	flag.StringVar(&storageTrieDir, "storage-trie-directory", "/tmp/storage-trie", "Directory where the storage trie node files are")
+	flag.StringVar(&ipfsRepoPath, "ipfs-repo-path", "~/.ipfs", "IPFS repository path")
+	flag.StringVar(&prefix, "prefix", "", "If set, will only process the files which name starts with <prefix>, in every account. Only two characters supported")
+	flag.Parse()
+
+	// Param check
+	if prefix != "" && len(prefix) != 2 {
+		fmt.Printf("ERROR: Param '--prefix' only supports two characters. Exiting")
+		os.Exit(1)
+	}
+
+	// IPFS
+	ipfs, err := lib.InitIPFSNode(ipfsRepoPath)
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		os.Exit(1)
+	}
+
+	// Launch the main loop
+	walker, err := lib.InitWalker(ipfs, storageTrieDir, prefix, "eth-storage-trie")
+	if err == nil {
+		err = walker.TraverseAccountDirectories()
+	}
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		os.Exit(1)
+	}
+
+	// Print the metrics
+	printReport()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ipfs/go-ipld-eth-import/lib"
+)
+
+/*
+
+## TRANSACTIONS IPFS
+
+Takes the transaction and transaction trie files dumped from the geth database
+and imports them to IPFS as `eth-tx` and `eth-tx-trie` objects.
+
+## EXAMPLE USAGE
+
+make tx-ipfs && ./build/bin/tx-ipfs --ipfs-repo-path ~/.ipfs
+
+*/
+
+func main() {
+	var (
+		txDir        string
+		ipfsRepoPath string
+		prefix       string
+	)
+
+	// Command line options
+	flag.StringVar(&txDir, "tx-directory", "/tmp/tx", "Directory where the eth-tx and eth-tx-trie directories are")
+	flag.StringVar(&ipfsRepoPath, "ipfs-repo-path", "~/.ipfs", "IPFS repository path")
+	flag.StringVar(&prefix, "prefix", "", "If set, will only process the files which name starts with <prefix>. Only two characters supported")
+	flag.Parse()
+
+	// Param check
+	if prefix != "" && len(prefix) != 2 {
+		fmt.Printf("ERROR: Param '--prefix' only supports two characters. Exiting")
+		os.Exit(1)
+	}
+
+	// IPFS
+	ipfs, err := lib.InitIPFSNode(ipfsRepoPath)
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		os.Exit(1)
+	}
+
+	// Launch the main loops, one per format
+	for _, format := range []string{"eth-tx", "eth-tx-trie"} {
+		walker, err := lib.InitWalker(ipfs, filepath.Join(txDir, format), prefix, format)
+		if err == nil {
+			err = walker.TraverseDirectory()
+		}
+		if err != nil {
+			fmt.Printf("ERROR: %v. Exiting\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Print the metrics
+	printReport()
+}
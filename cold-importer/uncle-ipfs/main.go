@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ipfs/go-ipld-eth-import/lib"
+)
+
+/*
+
+## UNCLES IPFS
+
+Takes the uncle header and uncle list files dumped from the geth database
+and imports them to IPFS as `eth-block` and `eth-block-list` objects.
+
+## EXAMPLE USAGE
+
+make uncle-ipfs && ./build/bin/uncle-ipfs --ipfs-repo-path ~/.ipfs
+
+*/
+
+func main() {
+	var (
+		uncleDir     string
+		ipfsRepoPath string
+		prefix       string
+	)
+
+	// Command line options
+	flag.StringVar(&uncleDir, "uncle-directory", "/tmp/uncle", "Directory where the eth-block and eth-block-list directories are")
+	flag.StringVar(&ipfsRepoPath, "ipfs-repo-path", "~/.ipfs", "IPFS repository path")
+	flag.StringVar(&prefix, "prefix", "", "If set, will only process the files which name starts with <prefix>. Only two characters supported")
+	flag.Parse()
+
+	// Param check
+	if prefix != "" && len(prefix) != 2 {
+		fmt.Printf("ERROR: Param '--prefix' only supports two characters. Exiting")
+		os.Exit(1)
+	}
+
+	// IPFS
+	ipfs, err := lib.InitIPFSNode(ipfsRepoPath)
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		os.Exit(1)
+	}
+
+	// Launch the main loops, one per format
+	for _, format := range []string{"eth-block", "eth-block-list"} {
+		walker, err := lib.InitWalker(ipfs, filepath.Join(uncleDir, format), prefix, format)
+		if err == nil {
+			err = walker.TraverseDirectory()
+		}
+		if err != nil {
+			fmt.Printf("ERROR: %v. Exiting\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Print the metrics
+	printReport()
+}
@@ -0,0 +1,84 @@
+package lib
+
+import (
+	"bytes"
+
+	common "github.com/ethereum/go-ethereum/common"
+	types "github.com/ethereum/go-ethereum/core/types"
+	rlp "github.com/ethereum/go-ethereum/rlp"
+	trie "github.com/ethereum/go-ethereum/trie"
+)
+
+// getBlockHeader will decode the given RLP into a block header.
+func getBlockHeader(rlpHeader []byte) (*types.Header, error) {
+	header := new(types.Header)
+	if err := rlp.Decode(bytes.NewReader(rlpHeader), header); err != nil {
+		// If we have an err here,
+		// it means our source database could be in bad shape.
+		return nil, &CorruptRLPError{Err: err}
+	}
+
+	return header, nil
+}
+
+// getBlockBody will decode the given RLP into a block body,
+// i.e. its transactions and ommers.
+func getBlockBody(rlpBody []byte) (*types.Body, error) {
+	body := new(types.Body)
+	if err := rlp.Decode(bytes.NewReader(rlpBody), body); err != nil {
+		return nil, &CorruptRLPError{Err: err}
+	}
+
+	return body, nil
+}
+
+// getBlockReceipts will decode the given RLP of receipts in their
+// storage form, returning them as consensus receipts.
+func getBlockReceipts(rlpReceipts []byte) (types.Receipts, error) {
+	storageReceipts := []*types.ReceiptForStorage{}
+	if err := rlp.DecodeBytes(rlpReceipts, &storageReceipts); err != nil {
+		return nil, &CorruptRLPError{Err: err}
+	}
+
+	receipts := make(types.Receipts, len(storageReceipts))
+	for idx, receipt := range storageReceipts {
+		receipts[idx] = (*types.Receipt)(receipt)
+	}
+
+	return receipts, nil
+}
+
+// trieNodeCollector complies with trie.DatabaseWriter, keeping in memory
+// the nodes of a trie being committed.
+type trieNodeCollector struct {
+	keys   [][]byte
+	values [][]byte
+}
+
+// Put stores a copy of the key and value, as the trie
+// reuses their slices across calls.
+func (c *trieNodeCollector) Put(key, value []byte) error {
+	c.keys = append(c.keys, common.CopyBytes(key))
+	c.values = append(c.values, common.CopyBytes(value))
+	return nil
+}
+
+// deriveTrie builds the trie of the given list the same way
+// types.DeriveSha does, returning its root and all of its nodes.
+func deriveTrie(list types.DerivableList) (common.Hash, *trieNodeCollector, error) {
+	keybuf := new(bytes.Buffer)
+	t := new(trie.Trie)
+	for i := 0; i < list.Len(); i++ {
+		keybuf.Reset()
+		rlp.Encode(keybuf, uint(i))
+		t.Update(keybuf.Bytes(), list.GetRlp(i))
+	}
+
+	collector := &trieNodeCollector{}
+	root, err := t.CommitTo(collector)
+	if err != nil {
+		return common.Hash{}, nil, err
+	}
+
+	return root, collector, nil
+}
@@ -0,0 +1,289 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	types "github.com/ethereum/go-ethereum/core/types"
+	crypto "github.com/ethereum/go-ethereum/crypto"
+	rlp "github.com/ethereum/go-ethereum/rlp"
+	metrics "github.com/ipfs/go-ipld-eth-import/metrics"
+)
+
+// BlockWalker iterates over a range of canonical block numbers
+// of the cold Geth DB, fetching the requested data of every block.
+type BlockWalker struct {
+	db                    *GethDB
+	dumpDir               string
+	operation             string
+	fromBlock             uint64
+	toBlock               uint64
+	iterationCheapCounter int
+}
+
+// NewBlockWalker sets up the metrics of this exercise and returns
+// the BlockWalker for further instructions.
+// Both fromBlock and toBlock are included in the range.
+func NewBlockWalker(db *GethDB, fromBlock, toBlock uint64, dumpDir, operation string) (*BlockWalker, error) {
+	// Metrics in this operation
+	metrics.NewLogger("traverse-blocks")
+	metrics.NewLogger("traverse-blocks-iterations")
+	metrics.NewLogger("new-nodes-bytes-tranferred")
+	metrics.NewLogger("file-creations")
+	metrics.NewCounter("traverse-blocks-headers")
+	metrics.NewCounter("traverse-blocks-transactions")
+	metrics.NewCounter("traverse-blocks-tx-trie-nodes")
+	metrics.NewCounter("traverse-blocks-receipts")
+	metrics.NewCounter("traverse-blocks-receipt-trie-nodes")
+	metrics.NewCounter("traverse-blocks-uncles")
+	metrics.NewCounter("traverse-blocks-uncle-lists")
+
+	if fromBlock > toBlock {
+		return nil, errors.New("the starting block number must not be greater than the final one")
+	}
+
+	bw := &BlockWalker{
+		db:                    db,
+		dumpDir:               dumpDir,
+		fromBlock:             fromBlock,
+		toBlock:               toBlock,
+		iterationCheapCounter: 0,
+	}
+
+	switch operation {
+	case "block-header":
+		bw.operation = "block-header"
+	case "tx":
+		bw.operation = "tx"
+	case "receipts":
+		bw.operation = "receipts"
+	case "uncles":
+		bw.operation = "uncles"
+	default:
+		return nil, errors.New("operation not supported")
+	}
+
+	return bw, nil
+}
+
+// TraverseBlocks is the main loop of the BlockWalker,
+// processing the blocks of the range one by one.
+// It stops at the first block which can not be processed,
+// returning a BlockError with the cause.
+func (bw *BlockWalker) TraverseBlocks() error {
+	_l := metrics.StartLogDiff("traverse-blocks")
+	defer metrics.StopLogDiff("traverse-blocks", _l)
+
+	for number := bw.fromBlock; number <= bw.toBlock; number++ {
+		bw.liveCounter()
+		if err := bw.traverseBlocksIteration(number); err != nil {
+			return &BlockError{Number: number, Err: err}
+		}
+
+		// Avoid the overflow when toBlock is the maximum uint64
+		if number == bw.toBlock {
+			break
+		}
+	}
+
+	return nil
+}
+
+// traverseBlocksIteration is the atomic component of the
+// loop in TraverseBlocks.
+func (bw *BlockWalker) traverseBlocksIteration(number uint64) error {
+	_l := metrics.StartLogDiff("traverse-blocks-iterations")
+	defer metrics.StopLogDiff("traverse-blocks-iterations", _l)
+
+	// Find the canonical block of this number
+	blockHash, err := bw.db.GetCanonicalHash(number)
+	if err != nil {
+		return err
+	}
+
+	headerRLP, err := bw.db.GetHeaderRLP(blockHash, number)
+	if err != nil {
+		return err
+	}
+
+	switch bw.operation {
+	case "block-header":
+		// The keccak256 of the header RLP is the block hash,
+		// so we use it as our key
+		metrics.IncCounter("traverse-blocks-headers")
+		metrics.AddLog("new-nodes-bytes-tranferred", int64(len(headerRLP)))
+		err = storeFile(bw.dumpDir, blockHash, headerRLP)
+	case "tx":
+		err = bw.storeTransactions(number, blockHash, headerRLP)
+	case "receipts":
+		err = bw.storeReceipts(number, blockHash, headerRLP)
+	case "uncles":
+		err = bw.storeUncles(number, blockHash, headerRLP)
+	}
+
+	return err
+}
+
+// storeTransactions decodes the body of the block, storing every
+// transaction under <dumpDir>/eth-tx, and the nodes of the rebuilt
+// transaction trie under <dumpDir>/eth-tx-trie.
+func (bw *BlockWalker) storeTransactions(number uint64, blockHash, headerRLP []byte) error {
+	header, err := getBlockHeader(headerRLP)
+	if err != nil {
+		return err
+	}
+	body, err := bw.fetchBody(number, blockHash)
+	if err != nil {
+		return err
+	}
+
+	for _, tx := range body.Transactions {
+		txRLP, err := rlp.EncodeToBytes(tx)
+		if err != nil {
+			return err
+		}
+		metrics.IncCounter("traverse-blocks-transactions")
+		err = storeFile(filepath.Join(bw.dumpDir, "eth-tx"), tx.Hash().Bytes(), txRLP)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Zero tolerance, the rebuilt trie must be
+	// the one the header links to
+	root, nodes, err := deriveTrie(types.Transactions(body.Transactions))
+	if err != nil {
+		return err
+	}
+	if root != header.TxHash {
+		return fmt.Errorf("transaction trie root does not match the header: %x != %x",
+			root, header.TxHash)
+	}
+
+	for idx, key := range nodes.keys {
+		metrics.IncCounter("traverse-blocks-tx-trie-nodes")
+		err = storeFile(filepath.Join(bw.dumpDir, "eth-tx-trie"), key, nodes.values[idx])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// storeUncles decodes the body of the block, storing every uncle header
+// under <dumpDir>/eth-block, and the RLP of the uncle list (i.e. the
+// preimage of the header's UncleHash) under <dumpDir>/eth-block-list.
+func (bw *BlockWalker) storeUncles(number uint64, blockHash, headerRLP []byte) error {
+	header, err := getBlockHeader(headerRLP)
+	if err != nil {
+		return err
+	}
+	body, err := bw.fetchBody(number, blockHash)
+	if err != nil {
+		return err
+	}
+
+	for _, uncle := range body.Uncles {
+		uncleRLP, err := rlp.EncodeToBytes(uncle)
+		if err != nil {
+			return err
+		}
+		metrics.IncCounter("traverse-blocks-uncles")
+		err = storeFile(filepath.Join(bw.dumpDir, "eth-block"), uncle.Hash().Bytes(), uncleRLP)
+		if err != nil {
+			return err
+		}
+	}
+
+	uncleListRLP, err := rlp.EncodeToBytes(body.Uncles)
+	if err != nil {
+		return err
+	}
+
+	// Zero tolerance, the list must be
+	// the one the header links to
+	uncleHash := crypto.Keccak256(uncleListRLP)
+	if !bytes.Equal(uncleHash, header.UncleHash.Bytes()) {
+		return fmt.Errorf("uncle list hash does not match the header: %x != %x",
+			uncleHash, header.UncleHash)
+	}
+
+	metrics.IncCounter("traverse-blocks-uncle-lists")
+	return storeFile(filepath.Join(bw.dumpDir, "eth-block-list"), uncleHash, uncleListRLP)
+}
+
+// storeReceipts decodes the receipts of the block, storing every
+// one of them under <dumpDir>/eth-tx-receipt, and the nodes of the rebuilt
+// receipt trie under <dumpDir>/eth-tx-receipt-trie.
+func (bw *BlockWalker) storeReceipts(number uint64, blockHash, headerRLP []byte) error {
+	header, err := getBlockHeader(headerRLP)
+	if err != nil {
+		return err
+	}
+
+	// Blocks without transactions may have no receipts stored
+	receiptsRLP, err := bw.db.GetReceiptsRLP(blockHash, number)
+	if _, missing := err.(*KeyNotFoundError); missing && header.ReceiptHash == emptyRoot {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	metrics.AddLog("new-nodes-bytes-tranferred", int64(len(receiptsRLP)))
+	receipts, err := getBlockReceipts(receiptsRLP)
+	if err != nil {
+		return err
+	}
+
+	// The consensus RLP is what gets hashed in the trie,
+	// so we store it with its keccak256 as key
+	for idx := range receipts {
+		receiptRLP := receipts.GetRlp(idx)
+		metrics.IncCounter("traverse-blocks-receipts")
+		err = storeFile(filepath.Join(bw.dumpDir, "eth-tx-receipt"), crypto.Keccak256(receiptRLP), receiptRLP)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Zero tolerance, the rebuilt trie must be
+	// the one the header links to
+	root, nodes, err := deriveTrie(receipts)
+	if err != nil {
+		return err
+	}
+	if root != header.ReceiptHash {
+		return fmt.Errorf("receipt trie root does not match the header: %x != %x",
+			root, header.ReceiptHash)
+	}
+
+	for idx, key := range nodes.keys {
+		metrics.IncCounter("traverse-blocks-receipt-trie-nodes")
+		err = storeFile(filepath.Join(bw.dumpDir, "eth-tx-receipt-trie"), key, nodes.values[idx])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fetchBody returns the decoded body of the given block.
+func (bw *BlockWalker) fetchBody(number uint64, blockHash []byte) (*types.Body, error) {
+	bodyRLP, err := bw.db.GetBodyRLP(blockHash, number)
+	if err != nil {
+		return nil, err
+	}
+	metrics.AddLog("new-nodes-bytes-tranferred", int64(len(bodyRLP)))
+
+	return getBlockBody(bodyRLP)
+}
+
+// liveCounter gives the lonely user some company
+func (bw *BlockWalker) liveCounter() {
+	bw.iterationCheapCounter++
+	fmt.Printf("%d\r", bw.iterationCheapCounter)
+}
@@ -0,0 +1,319 @@
+package lib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	common "github.com/ethereum/go-ethereum/common"
+	types "github.com/ethereum/go-ethereum/core/types"
+	crypto "github.com/ethereum/go-ethereum/crypto"
+	rlp "github.com/ethereum/go-ethereum/rlp"
+	trie "github.com/ethereum/go-ethereum/trie"
+)
+
+// newBlocksFixtureDB writes a geth database with the blocks written
+// by the given function, besides the one of newCustomFixtureDB.
+func newBlocksFixtureDB(t *testing.T, fill func(w fixtureWriter)) (*GethDB, func()) {
+	db, clean := newCustomFixtureDB(t, func(w fixtureWriter, state *trie.Trie) {})
+	fill(fixtureWriter{db: db.db})
+
+	return db, clean
+}
+
+// writeFixtureBody writes the body of the block of
+// the given number and hash, as geth does.
+func writeFixtureBody(t *testing.T, w fixtureWriter, number uint64, hash []byte, body *types.Body) {
+	bodyRLP, err := rlp.EncodeToBytes(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedNumber := make([]byte, 8)
+	binary.BigEndian.PutUint64(encodedNumber, number)
+	w.Put(append(append([]byte("b"), encodedNumber...), hash...), bodyRLP)
+}
+
+// readDumpDir returns the files written by storeFile under the
+// given directory, keyed by their names, checking that every one
+// of them is named after the keccak256 hash of its contents.
+func readDumpDir(t *testing.T, dumpDir string) map[string][]byte {
+	files := make(map[string][]byte)
+	err := filepath.Walk(dumpDir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == dumpDir {
+			return filepath.SkipDir
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if name := fmt.Sprintf("%x", crypto.Keccak256(data)); name != info.Name() {
+			t.Errorf("the file %s holds the block %s", path, name)
+		}
+		files[info.Name()] = data
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return files
+}
+
+func TestBlockHeaders(t *testing.T) {
+	want := make(map[string][]byte)
+	db, cleanDB := newBlocksFixtureDB(t, func(w fixtureWriter) {
+		for number := uint64(2); number <= 4; number++ {
+			header := &types.Header{Extra: []byte{byte(number)}}
+			hash := writeFixtureHeader(t, w, number, header)
+			want[fmt.Sprintf("%x", hash)], _ = rlp.EncodeToBytes(header)
+		}
+	})
+	defer cleanDB()
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	bw, err := NewBlockWalker(db, 2, 4, dir, "block-header")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bw.TraverseBlocks(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readDumpDir(t, dir)
+	if len(got) != len(want) {
+		t.Fatalf("got %d headers, want %d", len(got), len(want))
+	}
+	for hash, header := range want {
+		if string(got[hash]) != string(header) {
+			t.Errorf("the header %s was not written", hash)
+		}
+	}
+
+	// A block missing in the database stops the walk
+	bw, err = NewBlockWalker(db, 4, 5, dir, "block-header")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bw.TraverseBlocks()
+	blockErr, ok := err.(*BlockError)
+	if !ok || blockErr.Number != 5 {
+		t.Fatalf("got %T (%v), want a *BlockError of block 5", err, err)
+	}
+	if _, ok := blockErr.Err.(*KeyNotFoundError); !ok {
+		t.Errorf("got the cause %T (%v), want a *KeyNotFoundError", blockErr.Err, blockErr.Err)
+	}
+}
+
+// checkDumpTrie checks that the nodes of the given files are the trie
+// of the given root, holding the given list as DeriveSha builds it.
+func checkDumpTrie(t *testing.T, files map[string][]byte, root common.Hash, list types.DerivableList) {
+	db := make(proofDB)
+	for _, data := range files {
+		db[string(crypto.Keccak256(data))] = data
+	}
+
+	for idx := 0; idx < list.Len(); idx++ {
+		key, _ := rlp.EncodeToBytes(uint(idx))
+		value, err, _ := trie.VerifyProof(root, key, db)
+		if err != nil {
+			t.Fatalf("item %d: %v", idx, err)
+		}
+		if string(value) != string(list.GetRlp(idx)) {
+			t.Fatalf("item %d is not in the trie", idx)
+		}
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	var txs types.Transactions
+	for idx := 0; idx < 20; idx++ {
+		txs = append(txs, types.NewTransaction(uint64(idx), common.BytesToAddress(fixtureAddress(idx)),
+			big.NewInt(int64(idx)), big.NewInt(21000), big.NewInt(1), []byte{byte(idx)}))
+	}
+	db, cleanDB := newBlocksFixtureDB(t, func(w fixtureWriter) {
+		// A block with transactions, and one without them
+		hash := writeFixtureHeader(t, w, 2, &types.Header{TxHash: types.DeriveSha(txs)})
+		writeFixtureBody(t, w, 2, hash, &types.Body{Transactions: txs})
+		hash = writeFixtureHeader(t, w, 3, &types.Header{TxHash: emptyRoot})
+		writeFixtureBody(t, w, 3, hash, &types.Body{})
+
+		// A header linking to other transactions
+		hash = writeFixtureHeader(t, w, 4, &types.Header{TxHash: emptyRoot})
+		writeFixtureBody(t, w, 4, hash, &types.Body{Transactions: txs[:1]})
+	})
+	defer cleanDB()
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	bw, err := NewBlockWalker(db, 2, 3, dir, "tx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bw.TraverseBlocks(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readDumpDir(t, filepath.Join(dir, "eth-tx"))
+	if len(got) != len(txs) {
+		t.Fatalf("got %d transactions, want %d", len(got), len(txs))
+	}
+	for _, tx := range txs {
+		txRLP, _ := rlp.EncodeToBytes(tx)
+		if string(got[fmt.Sprintf("%x", tx.Hash())]) != string(txRLP) {
+			t.Fatalf("the transaction %x was not written", tx.Hash())
+		}
+	}
+	checkDumpTrie(t, readDumpDir(t, filepath.Join(dir, "eth-tx-trie")), types.DeriveSha(txs), txs)
+
+	bw, err = NewBlockWalker(db, 4, 4, dir, "tx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bw.TraverseBlocks()
+	if blockErr, ok := err.(*BlockError); !ok || blockErr.Number != 4 {
+		t.Fatalf("got %T (%v), want a *BlockError of block 4", err, err)
+	}
+}
+
+func TestReceipts(t *testing.T) {
+	var receipts types.Receipts
+	for idx := 0; idx < 10; idx++ {
+		receipt := types.NewReceipt(nil, idx%4 == 3, big.NewInt(int64(21000*(idx+1))))
+		receipt.Logs = []*types.Log{{Address: common.BytesToAddress(fixtureAddress(idx)), Data: []byte{byte(idx)}}}
+		receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
+		receipt.TxHash = common.BytesToHash(crypto.Keccak256([]byte{byte(idx)}))
+		receipt.GasUsed = big.NewInt(21000)
+		receipts = append(receipts, receipt)
+	}
+	writeReceipts := func(w fixtureWriter, number uint64, hash []byte, receipts types.Receipts) {
+		stored := make([]*types.ReceiptForStorage, len(receipts))
+		for idx, receipt := range receipts {
+			stored[idx] = (*types.ReceiptForStorage)(receipt)
+		}
+		receiptsRLP, err := rlp.EncodeToBytes(stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encodedNumber := make([]byte, 8)
+		binary.BigEndian.PutUint64(encodedNumber, number)
+		w.Put(append(append([]byte("r"), encodedNumber...), hash...), receiptsRLP)
+	}
+	db, cleanDB := newBlocksFixtureDB(t, func(w fixtureWriter) {
+		// A block with receipts, and one with none stored
+		hash := writeFixtureHeader(t, w, 2, &types.Header{ReceiptHash: types.DeriveSha(receipts)})
+		writeReceipts(w, 2, hash, receipts)
+		writeFixtureHeader(t, w, 3, &types.Header{ReceiptHash: emptyRoot})
+
+		// A header linking to other receipts
+		hash = writeFixtureHeader(t, w, 4, &types.Header{ReceiptHash: emptyRoot})
+		writeReceipts(w, 4, hash, receipts[:1])
+	})
+	defer cleanDB()
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	bw, err := NewBlockWalker(db, 2, 3, dir, "receipts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bw.TraverseBlocks(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The receipts are written in their consensus form
+	got := readDumpDir(t, filepath.Join(dir, "eth-tx-receipt"))
+	if len(got) != len(receipts) {
+		t.Fatalf("got %d receipts, want %d", len(got), len(receipts))
+	}
+	for idx := range receipts {
+		receiptRLP := receipts.GetRlp(idx)
+		if string(got[fmt.Sprintf("%x", crypto.Keccak256(receiptRLP))]) != string(receiptRLP) {
+			t.Fatalf("the receipt %d was not written", idx)
+		}
+	}
+	checkDumpTrie(t, readDumpDir(t, filepath.Join(dir, "eth-tx-receipt-trie")), types.DeriveSha(receipts), receipts)
+
+	bw, err = NewBlockWalker(db, 4, 4, dir, "receipts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bw.TraverseBlocks()
+	if blockErr, ok := err.(*BlockError); !ok || blockErr.Number != 4 {
+		t.Fatalf("got %T (%v), want a *BlockError of block 4", err, err)
+	}
+}
+
+func TestUncles(t *testing.T) {
+	var uncles []*types.Header
+	for idx := 0; idx < 2; idx++ {
+		uncles = append(uncles, &types.Header{
+			Number:     big.NewInt(1),
+			Difficulty: big.NewInt(int64(idx)),
+			GasLimit:   big.NewInt(0),
+			GasUsed:    big.NewInt(0),
+			Time:       big.NewInt(0),
+		})
+	}
+	db, cleanDB := newBlocksFixtureDB(t, func(w fixtureWriter) {
+		// A block with uncles, and one without them
+		hash := writeFixtureHeader(t, w, 2, &types.Header{UncleHash: types.CalcUncleHash(uncles)})
+		writeFixtureBody(t, w, 2, hash, &types.Body{Uncles: uncles})
+		hash = writeFixtureHeader(t, w, 3, &types.Header{UncleHash: types.EmptyUncleHash})
+		writeFixtureBody(t, w, 3, hash, &types.Body{})
+
+		// A header linking to other uncles
+		hash = writeFixtureHeader(t, w, 4, &types.Header{UncleHash: types.EmptyUncleHash})
+		writeFixtureBody(t, w, 4, hash, &types.Body{Uncles: uncles[:1]})
+	})
+	defer cleanDB()
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	bw, err := NewBlockWalker(db, 2, 3, dir, "uncles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bw.TraverseBlocks(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readDumpDir(t, filepath.Join(dir, "eth-block"))
+	if len(got) != len(uncles) {
+		t.Fatalf("got %d uncles, want %d", len(got), len(uncles))
+	}
+	for _, uncle := range uncles {
+		uncleRLP, _ := rlp.EncodeToBytes(uncle)
+		if string(got[fmt.Sprintf("%x", uncle.Hash())]) != string(uncleRLP) {
+			t.Fatalf("the uncle %x was not written", uncle.Hash())
+		}
+	}
+
+	// Both lists are written, the empty one included
+	lists := readDumpDir(t, filepath.Join(dir, "eth-block-list"))
+	for _, hash := range []common.Hash{types.CalcUncleHash(uncles), types.EmptyUncleHash} {
+		if _, ok := lists[fmt.Sprintf("%x", hash)]; !ok {
+			t.Fatalf("the uncle list %x was not written", hash)
+		}
+	}
+	if len(lists) != 2 {
+		t.Fatalf("got %d uncle lists, want 2", len(lists))
+	}
+
+	bw, err = NewBlockWalker(db, 4, 4, dir, "uncles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bw.TraverseBlocks()
+	if blockErr, ok := err.(*BlockError); !ok || blockErr.Number != 4 {
+		t.Fatalf("got %T (%v), want a *BlockError of block 4", err, err)
+	}
+}
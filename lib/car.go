@@ -0,0 +1,163 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	cid "github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// formatCodecs maps the formats we import into
+// IPFS to the cid codecs of their IPLD blocks.
+var formatCodecs = map[string]uint64{
+	"importer-ipld-raw-data": MRawData,
+	"eth-block":              MEthBlock,
+	"eth-block-list":         MEthBlockList,
+	"eth-tx":                 MEthTx,
+	"eth-tx-trie":            MEthTxTrie,
+	"eth-tx-receipt":         MEthTxReceipt,
+	"eth-tx-receipt-trie":    MEthTxReceiptTrie,
+	"eth-state-trie":         MEthStateTrie,
+	"eth-storage-trie":       MEthStorageTrie,
+}
+
+// carWriter writes IPLD blocks into a CARv1 file: a header with the root
+// CID, followed by a section per block. Both the header and the sections
+// are prefixed by their length, as an unsigned varint.
+// See https://github.com/ipld/specs/blob/master/block-layer/content-addressable-archives.md
+// The size counts what was written, flushed or not.
+type carWriter struct {
+	file *os.File
+	w    *bufio.Writer
+	size int64
+
+	// Whether the block of the root was written since we created it
+	root        *cid.Cid
+	rootWritten bool
+}
+
+// createCAR creates the CAR file of the given root CID, writing its
+// header. To resume a previous export, the offset is the size the file
+// had when it was last flushed, and the blocks are written from there,
+// dropping whatever was written after it.
+func createCAR(path string, root *cid.Cid, offset int64) (*carWriter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = file.Truncate(offset); err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	cw := &carWriter{file: file, w: bufio.NewWriter(file), size: offset, root: root}
+	if offset == 0 {
+		err = cw.writeSection(carHeader(root))
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	return cw, nil
+}
+
+// carHeader encodes the header of a CARv1 file as dag-cbor,
+// i.e. the map {"roots": [<root>], "version": 1}, with the
+// keys in canonical order, and the root CID with the tag 42.
+func carHeader(root *cid.Cid) []byte {
+	// The CID goes as a byte string, prefixed by a zero byte
+	rootBytes := append([]byte{0}, root.Bytes()...)
+
+	out := []byte{0xa2}
+	out = append(out, 0x65)
+	out = append(out, "roots"...)
+	out = append(out, 0x81, 0xd8, 0x2a)
+	out = append(out, cborBytesHeader(len(rootBytes))...)
+	out = append(out, rootBytes...)
+	out = append(out, 0x67)
+	out = append(out, "version"...)
+	out = append(out, 0x01)
+
+	return out
+}
+
+// cborBytesHeader returns the CBOR header of a byte string
+// of the given length.
+func cborBytesHeader(n int) []byte {
+	switch {
+	case n < 24:
+		return []byte{0x40 | byte(n)}
+	case n < 256:
+		return []byte{0x58, byte(n)}
+	default:
+		return []byte{0x59, byte(n >> 8), byte(n)}
+	}
+}
+
+// add writes the given block, whose CID is computed as a
+// <codec> = keccak256 IPLD block, as the ones we import into IPFS.
+func (cw *carWriter) add(codec uint64, data []byte) error {
+	c, err := keccakCid(codec, data)
+	if err != nil {
+		return err
+	}
+	if c.Equals(cw.root) {
+		cw.rootWritten = true
+	}
+
+	return cw.writeSection(append(c.Bytes(), data...))
+}
+
+// writeSection writes the given data, prefixed by its length.
+func (cw *carWriter) writeSection(data []byte) error {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(data)))
+
+	if _, err := cw.w.Write(buf[:n]); err != nil {
+		return err
+	}
+	if _, err := cw.w.Write(data); err != nil {
+		return err
+	}
+
+	cw.size += int64(n + len(data))
+	return nil
+}
+
+// flush writes the blocks kept in memory into the file.
+func (cw *carWriter) flush() error {
+	return cw.w.Flush()
+}
+
+// close writes what is left in memory, and closes the file.
+func (cw *carWriter) close() error {
+	err := cw.flush()
+	if cerr := cw.file.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// keyCid returns the CID of the IPLD block of the given codec whose
+// keccak256 hash is the given key, i.e. a state root or a block hash.
+func keyCid(codec uint64, key []byte) (*cid.Cid, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("wrong keccak256 hash %x", key)
+	}
+
+	hash, err := mh.Encode(key, mh.KECCAK_256)
+	if err != nil {
+		return nil, err
+	}
+
+	return cid.NewCidV1(codec, mh.Multihash(hash)), nil
+}
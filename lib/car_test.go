@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestCARHeader(t *testing.T) {
+	hash := bytes.Repeat([]byte{0xab}, 32)
+	root, err := keyCid(MEthBlock, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// {"roots": [<root>], "version": 1} as dag-cbor
+	want := []byte{0xa2, 0x65}
+	want = append(want, "roots"...)
+	want = append(want, 0x81, 0xd8, 0x2a)
+	// A byte string of 38 bytes: a zero byte, and the CIDv1
+	// <version 1><codec 0x90 as a varint><keccak-256 0x1b><32 bytes>
+	want = append(want, 0x58, 38, 0x00, 0x01, 0x90, 0x01, 0x1b, 0x20)
+	want = append(want, hash...)
+	want = append(want, 0x67)
+	want = append(want, "version"...)
+	want = append(want, 0x01)
+
+	if got := carHeader(root); !bytes.Equal(got, want) {
+		t.Fatalf("got %x, want %x", got, want)
+	}
+}
+
+func TestCBORBytesHeader(t *testing.T) {
+	for _, tc := range []struct {
+		n    int
+		want []byte
+	}{
+		{0, []byte{0x40}},
+		{23, []byte{0x57}},
+		{24, []byte{0x58, 0x18}},
+		{38, []byte{0x58, 0x26}},
+		{255, []byte{0x58, 0xff}},
+		{256, []byte{0x59, 0x01, 0x00}},
+	} {
+		if got := cborBytesHeader(tc.n); !bytes.Equal(got, tc.want) {
+			t.Errorf("%d: got %x, want %x", tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestCreateCAR(t *testing.T) {
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	header := []byte("a block header")
+	root, err := keccakCid(MEthBlock, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "block.car")
+	car, err := createCAR(path, root, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = car.add(MEthBlock, header); err != nil {
+		t.Fatal(err)
+	}
+	if err = car.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The header, and a section with the CID and the data of the block
+	var want []byte
+	rootHeader := carHeader(root)
+	want = append(want, byte(len(rootHeader)))
+	want = append(want, rootHeader...)
+	want = append(want, byte(len(root.Bytes())+len(header)))
+	want = append(want, root.Bytes()...)
+	want = append(want, header...)
+
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %x, want %x", got, want)
+	}
+	if car.size != int64(len(want)) {
+		t.Fatalf("the size is %d, want %d", car.size, len(want))
+	}
+	if !car.rootWritten {
+		t.Fatal("the root block is not known to be written")
+	}
+}
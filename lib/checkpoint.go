@@ -0,0 +1,204 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	metrics "github.com/ipfs/go-ipld-eth-import/metrics"
+)
+
+// checkpointInterval is the number of iterations between checkpoints.
+var checkpointInterval = 100000
+
+// trieStackCheckpoint is what we need to resume an interrupted traversal.
+// The stack on disk is ahead of what was flushed into the sink since the
+// last checkpoint, so the checkpoint keeps a copy of it, from the bottom
+// to the top, to go back to it. Being as deep as the tries, it is small.
+// The counters are the ones of this traversal alone, as the shards of a
+// TriePool share the metrics.
+// The traversal is told apart by the operation of its configuration,
+// empty for a Visitor, and by what it goes through. The storage-slots
+// operation keeps the accounts it found so far.
+type trieStackCheckpoint struct {
+	Operation    string         `json:"operation"`
+	StorageTries bool           `json:"storageTries"`
+	EVMCodes     bool           `json:"evmCodes"`
+	Diff         bool           `json:"diff"`
+	Nibble       string         `json:"nibble"`
+	BlockNumbers []uint64       `json:"blockNumbers"`
+	BlockIndex   int            `json:"blockIndex"`
+	RootPushed   bool           `json:"rootPushed"`
+	Iterations   int            `json:"iterations"`
+	Counters     map[string]int `json:"counters"`
+	Stack        [][]byte       `json:"stack"`
+	SnapshotSize int64          `json:"snapshotSize"`
+	PathsSize    int64          `json:"pathsSize"`
+	ProblemsSize int64          `json:"problemsSize"`
+	Found        [][]byte       `json:"found"`
+}
+
+// saveCheckpoint writes the current state of the traversal into
+// the checkpoint file. It writes a temporary file first, so a crash
+// in the middle does not leave us without a valid checkpoint.
+// The sink, the paths index, the verify report and the snapshot
+// are flushed before that. Their sizes are kept, to drop what is
+// written after the checkpoint when resuming.
+func (ts *TrieStack) saveCheckpoint() error {
+	if ts.sink != nil {
+		if err := ts.sink.Flush(); err != nil {
+			return err
+		}
+	}
+	var pathsSize int64
+	if ts.paths != nil {
+		var err error
+		if pathsSize, err = ts.paths.flushedSize(); err != nil {
+			return err
+		}
+	}
+	var problemsSize int64
+	if ts.problems != nil {
+		var err error
+		if problemsSize, err = ts.problems.flushedSize(); err != nil {
+			return err
+		}
+	}
+	var snapshotSize int64
+	if ts.snapshot != nil {
+		var err error
+		if snapshotSize, err = ts.snapshot.flushedSize(); err != nil {
+			return err
+		}
+	}
+
+	stack, err := ts.stackItems()
+	if err != nil {
+		return err
+	}
+
+	cp := &trieStackCheckpoint{
+		Operation:    ts.configOperation,
+		StorageTries: ts.storageTries,
+		EVMCodes:     ts.evmCodes,
+		Diff:         ts.diff,
+		Nibble:       ts.nibble,
+		BlockNumbers: ts.blockNumbers,
+		BlockIndex:   ts.blockIndex,
+		RootPushed:   ts.rootPushed,
+		Iterations:   ts.iterationCheapCounter,
+		Counters:     ts.counters,
+		Stack:        stack,
+		SnapshotSize: snapshotSize,
+		PathsSize:    pathsSize,
+		ProblemsSize: problemsSize,
+		Found:        ts.foundAccounts(),
+	}
+
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(ts.checkpointPath+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(ts.checkpointPath+".tmp", ts.checkpointPath)
+	if err != nil {
+		return err
+	}
+
+	ts.lastCheckpoint = ts.iterationCheapCounter
+	return nil
+}
+
+// stackItems returns the items of the traversal stack,
+// from the bottom to the top.
+func (ts *TrieStack) stackItems() ([][]byte, error) {
+	length := ts.Length()
+	out := make([][]byte, 0, length)
+	for offset := length; offset > 0; offset-- {
+		item, err := ts.PeekByOffset(offset - 1)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item.Value)
+	}
+
+	return out, nil
+}
+
+// loadCheckpoint reads the checkpoint file of a previous traversal.
+func loadCheckpoint(checkpointPath string) (*trieStackCheckpoint, error) {
+	data, err := ioutil.ReadFile(checkpointPath)
+	if os.IsNotExist(err) {
+		return nil, errors.New("there is no traversal to resume")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cp := &trieStackCheckpoint{}
+	err = json.Unmarshal(data, cp)
+	if err != nil {
+		return nil, err
+	}
+
+	return cp, nil
+}
+
+// addCounters adds to the counters of the metrics what
+// the traversal of the given checkpoint counted.
+func addCounters(cp *trieStackCheckpoint) {
+	for key, val := range cp.Counters {
+		metrics.AddCounter(key, val)
+	}
+}
+
+// restoreCheckpoint takes the state of a previous traversal from its
+// checkpoint, making sure it was doing the same work we are asked for.
+func (ts *TrieStack) restoreCheckpoint(cp *trieStackCheckpoint) error {
+	if cp.Operation != ts.configOperation {
+		if cp.Operation == "" {
+			return errors.New("the traversal to resume was going through a visitor")
+		}
+		return errors.New("the traversal to resume was performing the operation " + cp.Operation)
+	}
+	if cp.StorageTries != ts.storageTries || cp.EVMCodes != ts.evmCodes || cp.Diff != ts.diff {
+		return errors.New("the traversal to resume was going through other tries")
+	}
+	if len(cp.BlockNumbers) != len(ts.blockNumbers) {
+		return errors.New("the traversal to resume was performed over a different range of blocks")
+	}
+	for idx, number := range cp.BlockNumbers {
+		if number != ts.blockNumbers[idx] {
+			return errors.New("the traversal to resume was performed over a different range of blocks")
+		}
+	}
+
+	if cp.Nibble != ts.nibble {
+		if cp.Nibble == "" {
+			return errors.New("the traversal to resume was not limited to a nibble")
+		}
+		return errors.New("the traversal to resume was limited to the nibble " + cp.Nibble)
+	}
+
+	ts.resumed = cp
+	ts.blockIndex = cp.BlockIndex
+	ts.rootPushed = cp.RootPushed
+	ts.iterationCheapCounter = cp.Iterations
+	ts.lastCheckpoint = cp.Iterations
+	if cp.Counters != nil {
+		ts.counters = cp.Counters
+	}
+	addCounters(cp)
+	for _, account := range cp.Found {
+		if _, ok := ts.accounts[string(account)]; ok {
+			ts.accounts[string(account)] = true
+		}
+	}
+
+	return nil
+}
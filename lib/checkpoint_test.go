@@ -0,0 +1,299 @@
+package lib
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// crashVisitor panics after visiting the given number of trie
+// nodes, as if the process died in the middle of a traversal.
+type crashVisitor struct {
+	Visitor
+	left int
+}
+
+func (cv *crashVisitor) OnBranch(node *TrieNode) error {
+	cv.crash()
+	return cv.Visitor.OnBranch(node)
+}
+
+func (cv *crashVisitor) OnExtension(node *TrieNode) error {
+	cv.crash()
+	return cv.Visitor.OnExtension(node)
+}
+
+func (cv *crashVisitor) OnLeaf(node *TrieNode) error {
+	cv.crash()
+	return cv.Visitor.OnLeaf(node)
+}
+
+func (cv *crashVisitor) crash() {
+	if cv.left == 0 {
+		panic("crash")
+	}
+	cv.left--
+}
+
+// crashTraversal traverses until the given number of trie nodes are
+// visited, and crashes, leaving the stack directory, and whatever
+// was not flushed, as a crash would.
+func crashTraversal(t *testing.T, db *GethDB, cfg *TrieStackConfig, nodes int) {
+	ts, err := NewTrieStack(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.visitor = &crashVisitor{Visitor: ts.visitor, left: nodes}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("the traversal did not crash")
+		}
+		ts.Stack.Close()
+		if ts.snapshot != nil {
+			ts.snapshot.file.Close()
+		}
+		releaseStackDir(ts.lock)
+	}()
+
+	ts.TraverseStateTrie()
+}
+
+// traverse traverses the whole trie with the given configuration.
+func traverse(t *testing.T, db *GethDB, cfg *TrieStackConfig) {
+	ts, err := NewTrieStack(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	if err = ts.TraverseStateTrie(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readCARBlocks returns how many times every block is in the given CAR
+// file, keyed by its section (its CID followed by its data).
+func readCARBlocks(t *testing.T, path string) map[string]int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := make(map[string]int)
+	header := true
+	for len(data) > 0 {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < size {
+			t.Fatalf("truncated CAR section")
+		}
+		if !header {
+			out[string(data[n:n+int(size)])]++
+		}
+		header = false
+		data = data[n+int(size):]
+	}
+
+	return out
+}
+
+func TestResumeCARAfterCrash(t *testing.T) {
+	db, cleanDB := newFixtureDB(t, 400)
+	defer cleanDB()
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	defer func(interval int) { checkpointInterval = interval }(checkpointInterval)
+	checkpointInterval = 100
+
+	stateRoot, err := db.GetStateRoot(fixtureBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The blocks of an export without interruptions
+	fullPath := filepath.Join(dir, "full.car")
+	sink, err := NewCARSink(fullPath, "eth-state-trie", stateRoot, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := fixtureConfig(filepath.Join(dir, "full"), "state-trie")
+	cfg.Sink = sink
+	traverse(t, db, cfg)
+	if err = sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := readCARBlocks(t, fullPath)
+
+	// Crash after 350 blocks, halfway between two checkpoints, and resume
+	path := filepath.Join(dir, "crashed.car")
+	sink, err = NewCARSink(path, "eth-state-trie", stateRoot, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = fixtureConfig(filepath.Join(dir, "crashed"), "state-trie")
+	cfg.Sink = sink
+	crashTraversal(t, db, cfg, 350)
+	sink.car.file.Close()
+
+	sink, err = NewCARSink(path, "eth-state-trie", stateRoot, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Sink = sink
+	cfg.Resume = true
+	traverse(t, db, cfg)
+	if err = sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got := readCARBlocks(t, path)
+
+	if len(want) < 300 {
+		t.Fatalf("the fixture trie has only %d nodes", len(want))
+	}
+	for block := range want {
+		if got[block] == 0 {
+			t.Fatalf("%d blocks of %d are missing after resuming", len(want)-len(got), len(want))
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d different blocks, want %d", len(got), len(want))
+	}
+}
+
+func TestResumeSnapshotAfterCrash(t *testing.T) {
+	db, cleanDB := newFixtureDB(t, 400)
+	defer cleanDB()
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	defer func(interval int) { checkpointInterval = interval }(checkpointInterval)
+	checkpointInterval = 100
+
+	// The snapshot of a traversal without interruptions
+	cfg := fixtureConfig(filepath.Join(dir, "full"), "accounts")
+	cfg.Snapshot = filepath.Join(dir, "full.csv")
+	cfg.SnapshotFormat = "csv"
+	traverse(t, db, cfg)
+	want, err := ioutil.ReadFile(cfg.Snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Crash halfway between two checkpoints, and resume
+	cfg = fixtureConfig(filepath.Join(dir, "crashed"), "accounts")
+	cfg.Snapshot = filepath.Join(dir, "crashed.csv")
+	cfg.SnapshotFormat = "csv"
+	crashTraversal(t, db, cfg, 350)
+	cfg.Resume = true
+	traverse(t, db, cfg)
+	got, err := ioutil.ReadFile(cfg.Snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != string(want) {
+		t.Fatalf("the resumed snapshot has %d lines, want %d",
+			strings.Count(string(got), "\n"), strings.Count(string(want), "\n"))
+	}
+}
+
+// batchSink keeps what is put in memory until it is flushed,
+// as IPFSSink does with its batch. A crash loses what it kept.
+type batchSink struct {
+	CountSink
+	batch     []string
+	committed map[string]int
+}
+
+func (bs *batchSink) Put(key, account, value []byte, format string) error {
+	bs.batch = append(bs.batch, string(key))
+	return nil
+}
+
+func (bs *batchSink) Flush() error {
+	for _, key := range bs.batch {
+		bs.committed[key]++
+	}
+	bs.batch = nil
+	return nil
+}
+
+func TestResumeBatchAfterCrash(t *testing.T) {
+	db, cleanDB := newFixtureDB(t, 400)
+	defer cleanDB()
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	defer func(interval int) { checkpointInterval = interval }(checkpointInterval)
+	checkpointInterval = 100
+
+	full := &batchSink{committed: make(map[string]int)}
+	cfg := fixtureConfig(filepath.Join(dir, "full"), "state-trie")
+	cfg.Sink = full
+	traverse(t, db, cfg)
+
+	// Crash halfway between two checkpoints, losing the batch, and resume
+	crashed := &batchSink{committed: make(map[string]int)}
+	cfg = fixtureConfig(filepath.Join(dir, "crashed"), "state-trie")
+	cfg.Sink = crashed
+	crashTraversal(t, db, cfg, 350)
+	crashed.batch = nil
+	cfg.Resume = true
+	traverse(t, db, cfg)
+
+	for key := range full.committed {
+		if crashed.committed[key] == 0 {
+			t.Fatalf("%d nodes of %d were never committed", len(full.committed)-len(crashed.committed), len(full.committed))
+		}
+	}
+}
+
+func TestResumePathsIndexAfterCrash(t *testing.T) {
+	db, cleanDB := newFixtureDB(t, 400)
+	defer cleanDB()
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	defer func(interval int) { checkpointInterval = interval }(checkpointInterval)
+	checkpointInterval = 100
+
+	// The index of a traversal without interruptions
+	cfg := fixtureConfig(filepath.Join(dir, "full"), "state-trie")
+	cfg.Sink = NewCountSink()
+	cfg.PathsIndex = filepath.Join(dir, "full.paths")
+	traverse(t, db, cfg)
+	want, err := ioutil.ReadFile(cfg.PathsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Crash halfway between two checkpoints, and resume
+	cfg = fixtureConfig(filepath.Join(dir, "crashed"), "state-trie")
+	cfg.Sink = NewCountSink()
+	cfg.PathsIndex = filepath.Join(dir, "crashed.paths")
+	crashTraversal(t, db, cfg, 350)
+	cfg.Resume = true
+	traverse(t, db, cfg)
+	got, err := ioutil.ReadFile(cfg.PathsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("the resumed index has %d lines, want %d",
+			strings.Count(string(got), "\n"), strings.Count(string(want), "\n"))
+	}
+
+	// Starting afresh, the previous index is dropped
+	cfg.Resume = false
+	traverse(t, db, cfg)
+	got, err = ioutil.ReadFile(cfg.PathsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("the index of a new traversal has %d lines, want %d",
+			strings.Count(string(got), "\n"), strings.Count(string(want), "\n"))
+	}
+}
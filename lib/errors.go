@@ -0,0 +1,101 @@
+package lib
+
+import "fmt"
+
+// KeyNotFoundError is returned when a key we need is missing in the
+// Geth database, i.e. a trie node, a canonical hash or a block body.
+type KeyNotFoundError struct {
+	Key []byte
+}
+
+func (e *KeyNotFoundError) Error() string {
+	return fmt.Sprintf("key %x not found in the geth database", e.Key)
+}
+
+// CorruptRLPError is returned when a value can not be decoded.
+// Key is the one of the value in the Geth database, when known.
+type CorruptRLPError struct {
+	Key []byte
+	Err error
+}
+
+func (e *CorruptRLPError) Error() string {
+	if e.Key == nil {
+		return fmt.Sprintf("corrupt RLP: %v", e.Err)
+	}
+	return fmt.Sprintf("corrupt RLP in key %x: %v", e.Key, e.Err)
+}
+
+// UnknownNodeTypeError is returned when a trie node is neither
+// a branch, an extension nor a leaf.
+// Key is the one of the node in the Geth database, when known.
+type UnknownNodeTypeError struct {
+	Key    []byte
+	Reason string
+}
+
+func (e *UnknownNodeTypeError) Error() string {
+	if e.Key == nil {
+		return fmt.Sprintf("unknown trie node type: %s", e.Reason)
+	}
+	return fmt.Sprintf("unknown trie node type in key %x: %s", e.Key, e.Reason)
+}
+
+// withKey tags the decoding errors with the key of the
+// value they were found in, if it was not known yet.
+func withKey(err error, key []byte) error {
+	switch e := err.(type) {
+	case *CorruptRLPError:
+		if e.Key == nil {
+			e.Key = key
+		}
+	case *UnknownNodeTypeError:
+		if e.Key == nil {
+			e.Key = key
+		}
+	}
+
+	return err
+}
+
+// BlockError is returned when a block can not be processed, i.e. its
+// header is missing. Err is the cause, i.e. a KeyNotFoundError.
+type BlockError struct {
+	Number uint64
+	Err    error
+}
+
+func (e *BlockError) Error() string {
+	return fmt.Sprintf("block %d: %v", e.Number, e.Err)
+}
+
+// Unwrap returns the cause of the error.
+func (e *BlockError) Unwrap() error { return e.Err }
+
+// ShardError is returned when a shard of a TriePool fails.
+// Err is the cause, i.e. a KeyNotFoundError.
+type ShardError struct {
+	Shard string
+	Err   error
+}
+
+func (e *ShardError) Error() string {
+	return fmt.Sprintf("shard %s: %v", e.Shard, e.Err)
+}
+
+// Unwrap returns the cause of the error.
+func (e *ShardError) Unwrap() error { return e.Err }
+
+// StorageSlotError is returned when the proof of a storage slot
+// can not be built. Err is the cause, i.e. a KeyNotFoundError.
+type StorageSlotError struct {
+	Slot []byte
+	Err  error
+}
+
+func (e *StorageSlotError) Error() string {
+	return fmt.Sprintf("storage key %x: %v", e.Slot, e.Err)
+}
+
+// Unwrap returns the cause of the error.
+func (e *StorageSlotError) Unwrap() error { return e.Err }
@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -10,18 +11,23 @@ import (
 )
 
 // Walker will traverse a directory and import the found files
-// into IPFS using a stripped down version of DagPut.
+// into IPFS using a stripped down version of DagPut, committing them in batches,
+// or put them into a Sink, i.e. a CARSink.
 // A prefix can also be setup to allow to some form of scalability.
 type Walker struct {
 	ipfs                  *IPFS
+	batch                 *ImportBatch
+	sink                  Sink
 	dirPath               string
 	prefix                string
+	format                string
 	iterationCheapCounter int
 }
 
 // InitWalker gives us the Walker object, and set up the metrics
-// of this exercise.
-func InitWalker(ipfs *IPFS, dirPath, prefix string) *Walker {
+// of this exercise. The format is the one given to DagPut
+// (i.e. "importer-ipld-raw-data", "eth-block").
+func InitWalker(ipfs *IPFS, dirPath, prefix, format string) (*Walker, error) {
 	// Metrics in this operation
 	metrics.NewLogger("traverse-directory")
 	metrics.NewLogger("process-file")
@@ -29,18 +35,51 @@ func InitWalker(ipfs *IPFS, dirPath, prefix string) *Walker {
 	metrics.NewLogger("ipfs-dag-put")
 	metrics.NewLogger("bytes-tranferred")
 
+	batch, err := ipfs.NewImportBatch(importBatchSize)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Walker{
 		ipfs:                  ipfs,
+		batch:                 batch,
 		dirPath:               dirPath,
 		prefix:                prefix,
+		format:                format,
 		iterationCheapCounter: 0,
+	}, nil
+}
+
+// InitSinkWalker gives us a Walker putting the files into the given
+// sink, instead of importing them into IPFS, i.e. a CARSink. The format
+// is the one given to DagPut, which sets the codec of the blocks.
+// The sink is left open, so the files of several directories can be
+// put into it, and it is up to the caller to close it.
+func InitSinkWalker(sink Sink, dirPath, prefix, format string) (*Walker, error) {
+	// Metrics in this operation
+	metrics.NewLogger("traverse-directory")
+	metrics.NewLogger("process-file")
+	metrics.NewLogger("read-file")
+
+	if _, ok := formatCodecs[format]; !ok {
+		return nil, fmt.Errorf("unknown format %s", format)
 	}
+
+	return &Walker{
+		sink:                  sink,
+		dirPath:               dirPath,
+		prefix:                prefix,
+		format:                format,
+		iterationCheapCounter: 0,
+	}, nil
 }
 
 // TraverseDirectory is the main loop of this importer,
 // it calls processFile as it goes encountering nodes.
-func (w *Walker) TraverseDirectory() {
+// It stops at the first file which can not be imported.
+func (w *Walker) TraverseDirectory() error {
 	_l := metrics.StartLogDiff("traverse-directory")
+	defer metrics.StopLogDiff("traverse-directory", _l)
 
 	// option --prefix makes the directory walk shorter.
 	if w.prefix != "" {
@@ -48,9 +87,49 @@ func (w *Walker) TraverseDirectory() {
 	}
 
 	// Walk all files in directory
-	filepath.Walk(w.dirPath, w.processFile)
+	err := filepath.Walk(w.dirPath, w.processFile)
+
+	return w.finish(err)
+}
+
+// TraverseAccountDirectories is TraverseDirectory for the dumps having
+// a subdirectory per account, as the one of storage-trie-file. The prefix
+// is looked for under the directory of every account, skipping the ones
+// with no files starting with it.
+func (w *Walker) TraverseAccountDirectories() error {
+	_l := metrics.StartLogDiff("traverse-directory")
+	defer metrics.StopLogDiff("traverse-directory", _l)
+
+	accounts, err := ioutil.ReadDir(w.dirPath)
+	if err != nil {
+		return w.finish(err)
+	}
+	for _, account := range accounts {
+		if !account.IsDir() {
+			continue
+		}
+
+		dirPath := filepath.Join(w.dirPath, account.Name(), w.prefix)
+		if _, serr := os.Stat(dirPath); os.IsNotExist(serr) {
+			continue
+		}
+		if err = filepath.Walk(dirPath, w.processFile); err != nil {
+			break
+		}
+	}
 
-	metrics.StopLogDiff("traverse-directory", _l)
+	return w.finish(err)
+}
+
+// finish commits what is left into IPFS, after a traversal
+// ending with the given error. The sink, if any, is left open.
+func (w *Walker) finish(err error) error {
+	if w.sink != nil || err != nil {
+		return err
+	}
+
+	// Commit what is left in the batch
+	return w.batch.Flush()
 }
 
 // processFile is the core component of the traversal loop.
@@ -62,6 +141,12 @@ func (w *Walker) processFile(path string, info os.FileInfo, err error) error {
 	// Output a number to the user
 	w.liveCounter()
 
+	// i.e. the directory does not exist
+	if err != nil {
+		metrics.StopLogDiff("process-file", _l)
+		return err
+	}
+
 	// Skip directories, of course
 	if info.IsDir() {
 		metrics.StopLogDiff("process-file", _l)
@@ -69,13 +154,26 @@ func (w *Walker) processFile(path string, info os.FileInfo, err error) error {
 	}
 
 	// Get the file contents
-	data := readFile(path)
+	data, err := readFile(path)
+	if err != nil {
+		metrics.StopLogDiff("process-file", _l)
+		return err
+	}
 
-	// And call `ipfs dag put`
-	importIntoIPFS(w.ipfs, data)
+	// And call `ipfs dag put`, in batches,
+	// or put it into the sink, keyed by its file name
+	if w.sink != nil {
+		key, _ := hex.DecodeString(info.Name())
+		err = w.sink.Put(key, nil, data, w.format)
+	} else {
+		err = importIntoIPFS(w.batch, data, w.format)
+	}
+	if err != nil {
+		err = fmt.Errorf("%s: %v", path, err)
+	}
 
 	metrics.StopLogDiff("process-file", _l)
-	return nil
+	return err
 }
 
 // liveCounter gives the lonely user some company
@@ -85,28 +183,64 @@ func (w *Walker) liveCounter() {
 }
 
 // readFile just calls ioutil.ReadFile and take metrics
-func readFile(path string) []byte {
+func readFile(path string) ([]byte, error) {
 	_l := metrics.StartLogDiff("read-file")
 
 	// Do it
 	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		panic(err)
-	}
 
 	metrics.StopLogDiff("read-file", _l)
-	return data
+	return data, err
 }
 
 // importIntoIPFS invokes our customized methods, leveraging
-// the DAG.
-func importIntoIPFS(ipfs *IPFS, rawData []byte) {
+// the DAG. The data is committed along with the rest of the batch.
+func importIntoIPFS(batch *ImportBatch, rawData []byte, format string) error {
 	_l := metrics.StartLogDiff("ipfs-dag-put")
 
 	// Import it into IPFS,
 	// with our stripped down functionality
-	ipfs.DagPut(rawData, "importer-ipld-raw-data")
+	_, err := batch.Add(rawData, format)
+	if err != nil {
+		metrics.StopLogDiff("ipfs-dag-put", _l)
+		return err
+	}
 
 	metrics.AddLog("bytes-tranferred", int64(len(rawData)))
 	metrics.StopLogDiff("ipfs-dag-put", _l)
+	return nil
+}
+
+// writeIntoCAR writes the data as an IPLD block
+// of the given codec into the CAR file.
+func writeIntoCAR(car *carWriter, codec uint64, rawData []byte) error {
+	_l := metrics.StartLogDiff("car-writes")
+
+	err := car.add(codec, rawData)
+	if err != nil {
+		metrics.StopLogDiff("car-writes", _l)
+		return err
+	}
+
+	metrics.AddLog("bytes-tranferred", int64(len(rawData)))
+	metrics.StopLogDiff("car-writes", _l)
+	return nil
+}
+
+// storeFile will take the given contents, and store them into
+// the file system, with the given key as a file name.
+// It will take the first three bytes as subdirectories,
+// to make its lookup easier.
+func storeFile(dumpDir string, key, contents []byte) error {
+	_l := metrics.StartLogDiff("file-creations")
+
+	fileName := fmt.Sprintf("%x", key)
+	fileDir := filepath.Join(dumpDir, fileName[0:2], fileName[2:4], fileName[4:6])
+	err := os.MkdirAll(fileDir, 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(fileDir, fileName), contents, 0644)
+	}
+
+	metrics.StopLogDiff("file-creations", _l)
+	return err
 }
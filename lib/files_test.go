@@ -0,0 +1,180 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	crypto "github.com/ethereum/go-ethereum/crypto"
+)
+
+// walkIntoCAR writes the files of the given dump of storage trie nodes
+// with the given prefix into a CAR file, returning its blocks. The same
+// node is found in several accounts, so they are written more than once.
+func walkIntoCAR(t *testing.T, dumpDir, carPath, prefix string, root []byte) map[string]int {
+	sink, err := NewCARSink(carPath, "eth-state-trie", root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	walker, err := InitSinkWalker(sink, dumpDir, prefix, "eth-storage-trie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = walker.TraverseAccountDirectories(); err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file is not created for a prefix without files
+	if _, err = os.Stat(carPath); os.IsNotExist(err) {
+		return nil
+	}
+	return readCARBlocks(t, carPath)
+}
+
+func TestTraverseAccountDirectories(t *testing.T) {
+	db, cleanDB := newFixtureDB(t, 400)
+	defer cleanDB()
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	// Dump the storage tries as storage-trie-file does
+	dumpDir := filepath.Join(dir, "dump")
+	cfg := fixtureConfig(dir, "storage-trie")
+	cfg.Sink = NewFileSink(dumpDir)
+	traverse(t, db, cfg)
+
+	var files int
+	filepath.Walk(dumpDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files++
+		}
+		return err
+	})
+	if files == 0 {
+		t.Fatal("no storage trie nodes were dumped")
+	}
+
+	stateRoot, err := db.GetStateRoot(fixtureBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := walkIntoCAR(t, dumpDir, filepath.Join(dir, "all.car"), "", stateRoot)
+	var blocks int
+	for _, count := range all {
+		blocks += count
+	}
+	if blocks != files {
+		t.Fatalf("got %d blocks, want %d", blocks, files)
+	}
+
+	// Every prefix takes the files starting with it in every account
+	got := make(map[string]int)
+	for n := 0; n < 256; n++ {
+		prefix := fmt.Sprintf("%02x", n)
+		for block, count := range walkIntoCAR(t, dumpDir, filepath.Join(dir, prefix+".car"), prefix, stateRoot) {
+			got[block] += count
+		}
+	}
+	if !reflect.DeepEqual(got, all) {
+		t.Fatalf("got %d different blocks with every prefix, want %d", len(got), len(all))
+	}
+}
+
+func TestCARSinkRootWritten(t *testing.T) {
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	header := []byte("a block header")
+	headerHash := crypto.Keccak256(header)
+	tx := []byte("a transaction")
+
+	for _, tc := range []struct {
+		blocks [][]byte
+		want   bool
+	}{
+		{[][]byte{tx}, false},
+		{[][]byte{tx, header}, true},
+		{[][]byte{header, tx}, true},
+	} {
+		sink, err := NewCARSink(filepath.Join(dir, "block.car"), "eth-block", headerHash, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, block := range tc.blocks {
+			format := "eth-tx"
+			if string(block) == string(header) {
+				format = "eth-block"
+			}
+			if err = sink.Put(crypto.Keccak256(block), nil, block, format); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sink.Close()
+
+		if sink.RootWritten() != tc.want {
+			t.Errorf("%q: RootWritten() is %v, want %v", tc.blocks, !tc.want, tc.want)
+		}
+	}
+}
+
+func TestCARSinkOfRunningExport(t *testing.T) {
+	db, cleanDB := newFixtureDB(t, 50)
+	defer cleanDB()
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	stateRoot, err := db.GetStateRoot(fixtureBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	carPath := filepath.Join(dir, "state.car")
+
+	// An export is running
+	sink, err := NewCARSink(carPath, "eth-state-trie", stateRoot, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := fixtureConfig(dir, "state-trie")
+	cfg.Sink = sink
+	ts, err := NewTrieStack(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	if err = sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	running, err := ioutil.ReadFile(carPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same one, started again, leaves its file alone
+	again, err := NewCARSink(carPath, "eth-state-trie", stateRoot, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = fixtureConfig(dir, "state-trie")
+	cfg.Sink = again
+	if ts, err := NewTrieStack(db, cfg); err == nil {
+		ts.Close()
+		t.Fatal("the stack directory of a running export is opened again")
+	}
+	if err = again.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(carPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(running) {
+		t.Fatalf("the file of the running export went from %d bytes to %d", len(running), len(data))
+	}
+	sink.Close()
+}
@@ -0,0 +1,161 @@
+package lib
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	common "github.com/ethereum/go-ethereum/common"
+	types "github.com/ethereum/go-ethereum/core/types"
+	crypto "github.com/ethereum/go-ethereum/crypto"
+	rlp "github.com/ethereum/go-ethereum/rlp"
+	trie "github.com/ethereum/go-ethereum/trie"
+	leveldb "github.com/syndtr/goleveldb/leveldb"
+)
+
+// fixtureBlock is the number of the block of the fixture database.
+const fixtureBlock = 1
+
+// fixtureWriter lets go-ethereum commit its tries into our leveldb.
+type fixtureWriter struct {
+	db *leveldb.DB
+}
+
+func (w fixtureWriter) Put(key, value []byte) error {
+	return w.db.Put(key, value, nil)
+}
+
+// newFixtureDB writes a geth database, into a temporary directory, with
+// the canonical header of fixtureBlock, whose state trie has the given
+// number of accounts. Every third account is a contract, with its EVM
+// code and a few storage slots. Everything is built by go-ethereum.
+// The returned function removes the database.
+func newFixtureDB(t *testing.T, accounts int) (*GethDB, func()) {
+	return newCustomFixtureDB(t, func(w fixtureWriter, state *trie.Trie) {
+		for idx := 0; idx < accounts; idx++ {
+			storageRoot, codeHash := emptyRoot, common.BytesToHash(emptyCodeHash)
+
+			if idx%3 == 0 {
+				slots := make(map[byte][]byte)
+				for slot := 0; slot < 1+idx%7; slot++ {
+					slots[byte(slot)] = big.NewInt(int64(slot + 1)).Bytes()
+				}
+				storageRoot = fixtureStorage(t, w, slots)
+
+				code := []byte{0x60, byte(idx), 0x60, byte(idx >> 8), 0x01}
+				codeHash = crypto.Keccak256Hash(code)
+				if err := w.Put(codeHash[:], code); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			state.Update(crypto.Keccak256(fixtureAddress(idx)), fixtureAccount(uint64(idx), storageRoot, codeHash))
+		}
+	})
+}
+
+// fixtureAddress returns the address of the account of the given index.
+func fixtureAddress(idx int) []byte {
+	return common.BigToAddress(big.NewInt(int64(idx + 1))).Bytes()
+}
+
+// fixtureAccount returns the RLP of an account with the given nonce,
+// a balance of 1000 times it, and the given storage root and code hash.
+func fixtureAccount(nonce uint64, storageRoot, codeHash common.Hash) []byte {
+	account, _ := rlp.EncodeToBytes([]interface{}{
+		nonce, big.NewInt(int64(1000 * nonce)), storageRoot, codeHash,
+	})
+	return account
+}
+
+// fixtureStorage commits a storage trie with the given values, keyed by
+// the positions of their slots, returning its root.
+func fixtureStorage(t *testing.T, w fixtureWriter, slots map[byte][]byte) common.Hash {
+	storage, _ := trie.New(common.Hash{}, nil)
+	for slot, value := range slots {
+		encoded, _ := rlp.EncodeToBytes(value)
+		storage.Update(crypto.Keccak256(common.LeftPadBytes([]byte{slot}, 32)), encoded)
+	}
+	root, err := storage.CommitTo(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return root
+}
+
+// newCustomFixtureDB writes a geth database as newFixtureDB does, with
+// the state trie filled by the given function.
+func newCustomFixtureDB(t *testing.T, fill func(w fixtureWriter, state *trie.Trie)) (*GethDB, func()) {
+	dir, err := ioutil.TempDir("", "fixture-geth-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ldb, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	w := fixtureWriter{db: ldb}
+
+	state, _ := trie.New(common.Hash{}, nil)
+	fill(w, state)
+	stateRoot, err := state.CommitTo(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFixtureHeader(t, w, fixtureBlock, &types.Header{Root: stateRoot})
+
+	return &GethDB{db: ldb}, func() {
+		ldb.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// writeFixtureHeader writes the given header as the canonical one of
+// the given block number, returning its hash.
+func writeFixtureHeader(t *testing.T, w fixtureWriter, number uint64, header *types.Header) []byte {
+	header.Number = new(big.Int).SetUint64(number)
+	for _, field := range []**big.Int{&header.Difficulty, &header.GasLimit, &header.GasUsed, &header.Time} {
+		if *field == nil {
+			*field = big.NewInt(0)
+		}
+	}
+
+	headerRLP, err := rlp.EncodeToBytes(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockHash := crypto.Keccak256(headerRLP)
+	encodedNumber := make([]byte, 8)
+	binary.BigEndian.PutUint64(encodedNumber, number)
+	w.Put(append(append([]byte("h"), encodedNumber...), 'n'), blockHash)
+	w.Put(append(append([]byte("h"), encodedNumber...), blockHash...), headerRLP)
+
+	return blockHash
+}
+
+// tempDir returns a new temporary directory, and a function removing it.
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "ipld-eth-import-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// fixtureConfig returns the configuration to traverse
+// fixtureBlock, keeping the stack under the given directory.
+func fixtureConfig(dir, operation string) *TrieStackConfig {
+	return &TrieStackConfig{
+		FromBlock: fixtureBlock,
+		ToBlock:   fixtureBlock,
+		Step:      1,
+		Operation: operation,
+		StackDir:  filepath.Join(dir, "stack"),
+	}
+}
@@ -2,10 +2,11 @@ package lib
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 
 	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/errors"
+	lerrors "github.com/syndtr/goleveldb/leveldb/errors"
 )
 
 // GethDB is a wrapper to the leveldb connection object,
@@ -15,20 +16,20 @@ type GethDB struct {
 }
 
 // GethDBInit creates the connection with the "cold" Geth LevelDB.
-func GethDBInit(path string) *GethDB {
+func GethDBInit(path string) (*GethDB, error) {
 	if path == "" {
-		panic("Path to the Geth's DB must be specified (--geth-db-filepath option)")
+		return nil, errors.New("Path to the Geth's DB must be specified (--geth-db-filepath option)")
 	}
 	db, err := leveldb.OpenFile(path, nil)
-	if _, corrupted := err.(*errors.ErrCorrupted); corrupted {
+	if _, corrupted := err.(*lerrors.ErrCorrupted); corrupted {
 		fmt.Println("Corrupt")
 		db, err = leveldb.RecoverFile(path, nil)
 	}
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	return &GethDB{db: db}
+	return &GethDB{db: db}, nil
 }
 
 // Stop Closes the DB
@@ -36,46 +37,90 @@ func (g *GethDB) Stop() {
 	g.db.Close()
 }
 
-// Get returns the value associated to that key in the DB
+// Get returns the value associated to that key in the DB.
+// If the key is missing, a KeyNotFoundError is returned.
 func (g *GethDB) Get(key []byte) ([]byte, error) {
-	return g.db.Get(key, nil)
+	val, err := g.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, &KeyNotFoundError{Key: key}
+	}
+
+	return val, err
 }
 
 // GetCanonicalHash returns the stored CHT Hash for a given number
-func (g *GethDB) GetCanonicalHash(number uint64) []byte {
+func (g *GethDB) GetCanonicalHash(number uint64) ([]byte, error) {
 	headerPrefix := []byte("h")
 	numSuffix := []byte("n")
 	encodedNumber := make([]byte, 8)
 	binary.BigEndian.PutUint64(encodedNumber, number)
 
 	key := append(append(headerPrefix, encodedNumber...), numSuffix...)
-	val, _ := g.db.Get(key, nil)
-
-	return val
+	return g.Get(key)
 }
 
 // GetHeaderRLP returns the RLP of the block header
 // for a pair (hash, number) as key
-func (g *GethDB) GetHeaderRLP(hash []byte, number uint64) []byte {
+func (g *GethDB) GetHeaderRLP(hash []byte, number uint64) ([]byte, error) {
 	headerPrefix := []byte("h")
 	encodedNumber := make([]byte, 8)
 	binary.BigEndian.PutUint64(encodedNumber, number)
 
 	key := append(append(headerPrefix, encodedNumber...), hash...)
 
-	val, _ := g.db.Get(key, nil)
-	return val
+	return g.Get(key)
 }
 
 // GetBodyRLP returns the RLP of the block header, plus ommer list
 // transactions for a pair (hash, number) as key
-func (g *GethDB) GetBodyRLP(hash []byte, number uint64) []byte {
+func (g *GethDB) GetBodyRLP(hash []byte, number uint64) ([]byte, error) {
 	bodyPrefix := []byte("b")
 	encodedNumber := make([]byte, 8)
 	binary.BigEndian.PutUint64(encodedNumber, number)
 
 	key := append(append(bodyPrefix, encodedNumber...), hash...)
 
-	val, _ := g.db.Get(key, nil)
-	return val
+	return g.Get(key)
+}
+
+// GetReceiptsRLP returns the RLP of the list of receipts of a block,
+// in their storage form, for a pair (hash, number) as key
+func (g *GethDB) GetReceiptsRLP(hash []byte, number uint64) ([]byte, error) {
+	receiptsPrefix := []byte("r")
+	encodedNumber := make([]byte, 8)
+	binary.BigEndian.PutUint64(encodedNumber, number)
+
+	key := append(append(receiptsPrefix, encodedNumber...), hash...)
+
+	return g.Get(key)
+}
+
+// GetPreimage returns the preimage of the given hash of a secure trie key
+// (i.e. the address of an account, or a storage slot), if geth kept it.
+func (g *GethDB) GetPreimage(hash []byte) ([]byte, error) {
+	preimagePrefix := []byte("secure-key-")
+
+	key := append(preimagePrefix, hash...)
+
+	return g.Get(key)
+}
+
+// GetStateRoot returns the state root of the block of the given
+// number in the canonical chain. A missing or corrupt header gives
+// a BlockError, whose cause is a KeyNotFoundError or a CorruptRLPError.
+func (g *GethDB) GetStateRoot(number uint64) ([]byte, error) {
+	blockHash, err := g.GetCanonicalHash(number)
+	if err != nil {
+		return nil, &BlockError{Number: number, Err: err}
+	}
+	headerRLP, err := g.GetHeaderRLP(blockHash, number)
+	if err != nil {
+		return nil, &BlockError{Number: number, Err: err}
+	}
+	header, err := getBlockHeader(headerRLP)
+	if err != nil {
+		return nil, &BlockError{Number: number, Err: err}
+	}
+
+	return header.Root[:], nil
 }
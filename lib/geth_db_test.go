@@ -0,0 +1,86 @@
+package lib
+
+import "testing"
+
+func TestGetStateRootErrors(t *testing.T) {
+	db, cleanDB := newFixtureDB(t, 10)
+	defer cleanDB()
+
+	// A block missing in the database
+	_, err := db.GetStateRoot(fixtureBlock + 1)
+	blockErr, ok := err.(*BlockError)
+	if !ok {
+		t.Fatalf("got %T (%v), want a *BlockError", err, err)
+	}
+	if blockErr.Number != fixtureBlock+1 {
+		t.Errorf("got block %d, want %d", blockErr.Number, fixtureBlock+1)
+	}
+	if _, ok := blockErr.Err.(*KeyNotFoundError); !ok {
+		t.Errorf("got the cause %T (%v), want a *KeyNotFoundError", blockErr.Err, blockErr.Err)
+	}
+
+	// A corrupt header
+	hash, err := db.GetCanonicalHash(fixtureBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := append(append([]byte("h"), 0, 0, 0, 0, 0, 0, 0, fixtureBlock), hash...)
+	if err = db.db.Put(key, []byte{0xc3, 0x01}, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.GetStateRoot(fixtureBlock)
+	blockErr, ok = err.(*BlockError)
+	if !ok {
+		t.Fatalf("got %T (%v), want a *BlockError", err, err)
+	}
+	if _, ok := blockErr.Err.(*CorruptRLPError); !ok {
+		t.Errorf("got the cause %T (%v), want a *CorruptRLPError", blockErr.Err, blockErr.Err)
+	}
+}
+
+func TestPoolShardError(t *testing.T) {
+	db, cleanDB := newFixtureDB(t, 100)
+	defer cleanDB()
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	// Take out a node of the shard 3
+	stateRoot, err := db.GetStateRoot(fixtureBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := db.Get(stateRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := DecodeTrieNode(val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	child := root.(*Branch).Child(3)
+	if err = db.db.Delete(child.Key, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := fixtureConfig(dir, "count-all")
+	tp, err := NewTriePool(db, cfg, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+	err = tp.TraverseStateTrie()
+	shardErr, ok := err.(*ShardError)
+	if !ok {
+		t.Fatalf("got %T (%v), want a *ShardError", err, err)
+	}
+	if shardErr.Shard != "3" {
+		t.Errorf("got shard %s, want 3", shardErr.Shard)
+	}
+	notFound, ok := shardErr.Err.(*KeyNotFoundError)
+	if !ok {
+		t.Fatalf("got the cause %T (%v), want a *KeyNotFoundError", shardErr.Err, shardErr.Err)
+	}
+	if string(notFound.Key) != string(child.Key) {
+		t.Errorf("got the key %x, want %x", notFound.Key, child.Key)
+	}
+}
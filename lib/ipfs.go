@@ -3,6 +3,7 @@ package lib
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	"io/ioutil"
 	"math"
@@ -11,12 +12,17 @@ import (
 	"github.com/ipfs/go-ipfs/commands/files"
 	"github.com/ipfs/go-ipfs/core"
 	"github.com/ipfs/go-ipfs/core/coredag"
+	dag "github.com/ipfs/go-ipfs/merkledag"
 	"github.com/ipfs/go-ipfs/repo/fsrepo"
 	ipldeth "github.com/ipfs/go-ipld-eth/plugin"
 	node "github.com/ipfs/go-ipld-format"
 	mh "github.com/multiformats/go-multihash"
 )
 
+// importBatchSize is the number of IPLD blocks our importers
+// commit at once into IPFS.
+const importBatchSize = 4096
+
 // IPFS wraps an ipfs node and its context.
 type IPFS struct {
 	n   *core.IpfsNode
@@ -24,10 +30,10 @@ type IPFS struct {
 }
 
 // InitIPFSNode returns an IPFS node with minimal functionality
-func InitIPFSNode(repoPath string) *IPFS {
+func InitIPFSNode(repoPath string) (*IPFS, error) {
 	r, err := fsrepo.Open(repoPath)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	ctx := context.Background()
@@ -38,43 +44,148 @@ func InitIPFSNode(repoPath string) *IPFS {
 
 	ipfsNode, err := core.NewNode(ctx, cfg)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	registerInputParsers()
 
-	coredag.DefaultInputEncParsers.AddParser("raw", "eth-state-trie", ipldeth.EthStateTrieRawInputParser)
-	coredag.DefaultInputEncParsers.AddParser("raw", "importer-ipld-raw-data", ipldRawNodeInputParser)
+	return &IPFS{n: ipfsNode, ctx: ctx}, nil
+}
 
-	return &IPFS{n: ipfsNode, ctx: ctx}
+// registerInputParsers lets DagPut parse the formats of our importers.
+func registerInputParsers() {
+	coredag.DefaultInputEncParsers.AddParser("raw", "eth-state-trie", ipldeth.EthStateTrieRawInputParser)
+	coredag.DefaultInputEncParsers.AddParser("raw", "importer-ipld-raw-data", ipldRawNodeInputParser(MRawData))
+	coredag.DefaultInputEncParsers.AddParser("raw", "eth-block", ipldRawNodeInputParser(MEthBlock))
+	coredag.DefaultInputEncParsers.AddParser("raw", "eth-block-list", ipldRawNodeInputParser(MEthBlockList))
+	coredag.DefaultInputEncParsers.AddParser("raw", "eth-tx", ipldRawNodeInputParser(MEthTx))
+	coredag.DefaultInputEncParsers.AddParser("raw", "eth-tx-trie", ipldRawNodeInputParser(MEthTxTrie))
+	coredag.DefaultInputEncParsers.AddParser("raw", "eth-tx-receipt", ipldRawNodeInputParser(MEthTxReceipt))
+	coredag.DefaultInputEncParsers.AddParser("raw", "eth-tx-receipt-trie", ipldRawNodeInputParser(MEthTxReceiptTrie))
+	coredag.DefaultInputEncParsers.AddParser("raw", "eth-storage-trie", ipldRawNodeInputParser(MEthStorageTrie))
 }
 
-// ipldRawNodeInputParser is a custom input parser
-// to be able to introduce a 0x55 = keccak256 IPLD BLock
-func ipldRawNodeInputParser(r io.Reader, mhtype uint64, mhLen int) ([]node.Node, error) {
-	rawdata, err := ioutil.ReadAll(r)
-	if err != nil {
-		panic(err)
+// ipldRawNodeInputParser returns a custom input parser
+// to be able to introduce a <codec> = keccak256 IPLD Block.
+// The data is imported as is, no links are resolved.
+func ipldRawNodeInputParser(codec uint64) func(io.Reader, uint64, int) ([]node.Node, error) {
+	return func(r io.Reader, mhtype uint64, mhLen int) ([]node.Node, error) {
+		rawdata, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+
+		c, err := keccakCid(codec, rawdata)
+		if err != nil {
+			return nil, err
+		}
+
+		rawNode := &IpldRawNode{
+			cid:     c,
+			rawdata: rawdata,
+		}
+
+		return []node.Node{rawNode}, nil
 	}
+}
 
-	c, err := cid.Prefix{
-		Codec:    0x55,
+// keccakCid returns the CID of the given data
+// as a <codec> = keccak256 IPLD block.
+func keccakCid(codec uint64, data []byte) (*cid.Cid, error) {
+	return cid.Prefix{
+		Codec:    codec,
 		Version:  1,
 		MhType:   mh.KECCAK_256,
 		MhLength: -1,
-	}.Sum(rawdata)
+	}.Sum(data)
+}
+
+// DagPut is a stripped down version of the `dag put` command in go-ipfs
+func (m *IPFS) DagPut(raw []byte, format string) (string, error) {
+	nd, err := parseRawNode(raw, format)
+	if err != nil {
+		return "", err
+	}
+
+	// Adding the IPLD block
+	b := m.n.DAG.Batch()
+	_, err = b.Add(nd)
+	if err != nil {
+		return "", err
+	}
+	err = b.Commit()
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
-	rawNode := &IpldRawNode{
-		cid:     c,
-		rawdata: rawdata,
+	return nd.String(), nil
+}
+
+// ImportBatch groups the IPLD blocks imported into IPFS, committing
+// them every <size> blocks, instead of one at a time as DagPut does.
+// The blocks not committed yet are lost if the process dies, so they
+// must be added again then, as a traversal resumed from its last
+// checkpoint does. It is not safe to use it from several goroutines.
+type ImportBatch struct {
+	ipfs  *IPFS
+	batch *dag.Batch
+	size  int
+	count int
+}
+
+// NewImportBatch returns an ImportBatch committing every <size> blocks.
+// Flush must be called once done, to commit the remaining ones.
+func (m *IPFS) NewImportBatch(size int) (*ImportBatch, error) {
+	if size < 1 {
+		return nil, errors.New("the size of the batch must be greater than zero")
 	}
 
-	return []node.Node{rawNode}, nil
+	return &ImportBatch{
+		ipfs:  m,
+		batch: m.n.DAG.Batch(),
+		size:  size,
+	}, nil
 }
 
-// DagPut is a stripped down version of the `dag put` command in go-ipfs
-func (m *IPFS) DagPut(raw []byte, format string) string {
+// Add parses the raw data with the given format, as DagPut does, adding
+// the resulting block to the batch. Once the batch is full, it is committed.
+func (ib *ImportBatch) Add(raw []byte, format string) (string, error) {
+	nd, err := parseRawNode(raw, format)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = ib.batch.Add(nd)
+	if err != nil {
+		return "", err
+	}
+
+	ib.count++
+	if ib.count >= ib.size {
+		err = ib.Flush()
+	}
+
+	return nd.String(), err
+}
+
+// Flush commits the blocks added to the batch so far.
+func (ib *ImportBatch) Flush() error {
+	if ib.count == 0 {
+		return nil
+	}
+
+	err := ib.batch.Commit()
+	if err != nil {
+		return err
+	}
+
+	ib.batch = ib.ipfs.n.DAG.Batch()
+	ib.count = 0
+	return nil
+}
+
+// parseRawNode parses the raw data into an IPLD node, using
+// the input parser registered for the given format.
+func parseRawNode(raw []byte, format string) (node.Node, error) {
 	// Dag Put command options
 	ienc := "raw"
 	mhType := uint64(math.MaxUint64)
@@ -87,22 +198,11 @@ func (m *IPFS) DagPut(raw []byte, format string) string {
 	// Parse your raw data into a DAG Node
 	nds, err := coredag.ParseInputs(ienc, format, file, mhType, -1)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	if len(nds) == 0 {
-		panic("no nodes returned from parse inputs")
-	}
-
-	// Adding the IPLD block
-	b := m.n.DAG.Batch()
-	_, err = b.Add(nds[0])
-	if err != nil {
-		panic(err)
-	}
-	err = b.Commit()
-	if err != nil {
-		panic(err)
+		return nil, errors.New("no nodes returned from parse inputs")
 	}
 
-	return nds[0].String()
+	return nds[0], nil
 }
@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"context"
+	"testing"
+
+	cid "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipfs/core"
+)
+
+// newMemoryIPFS returns an offline IPFS node keeping its blocks in
+// memory, with our input parsers, and a function closing it.
+func newMemoryIPFS(t *testing.T) (*IPFS, func()) {
+	ctx := context.Background()
+	ipfsNode, err := core.NewNode(ctx, &core.BuildCfg{Online: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerInputParsers()
+
+	return &IPFS{n: ipfsNode, ctx: ctx}, func() { ipfsNode.Close() }
+}
+
+// hasBlock tells whether the blockstore of the given node
+// has the block of the given CID.
+func hasBlock(t *testing.T, ipfs *IPFS, c *cid.Cid) bool {
+	has, err := ipfs.n.Blockstore.Has(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return has
+}
+
+func TestImportBatch(t *testing.T) {
+	ipfs, closeIPFS := newMemoryIPFS(t)
+	defer closeIPFS()
+
+	if _, err := ipfs.NewImportBatch(0); err == nil {
+		t.Fatal("got a batch of no blocks")
+	}
+	batch, err := ipfs.NewImportBatch(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every third block commits the ones added so far
+	var cids []*cid.Cid
+	for idx := 0; idx < 7; idx++ {
+		data := []byte{0x60, byte(idx)}
+		if _, err := batch.Add(data, "importer-ipld-raw-data"); err != nil {
+			t.Fatal(err)
+		}
+		c, _ := keccakCid(MRawData, data)
+		cids = append(cids, c)
+
+		for n, c := range cids {
+			if committed := n < (idx+1)/3*3; hasBlock(t, ipfs, c) != committed {
+				t.Fatalf("after adding %d blocks, the block %d committed: %v", idx+1, n, !committed)
+			}
+		}
+	}
+
+	if err = batch.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for n, c := range cids {
+		if !hasBlock(t, ipfs, c) {
+			t.Fatalf("the block %d was not committed", n)
+		}
+	}
+	if err = batch.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIPFSSink(t *testing.T) {
+	db, cleanDB := newFixtureDB(t, 400)
+	defer cleanDB()
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+	ipfs, closeIPFS := newMemoryIPFS(t)
+	defer closeIPFS()
+
+	// The nodes of the state trie
+	nodes := &memorySink{puts: make(map[string]int)}
+	cfg := fixtureConfig(dir, "state-trie")
+	cfg.Sink = nodes
+	traverse(t, db, cfg)
+
+	sink, err := NewIPFSSink(ipfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Sink = sink
+	traverse(t, db, cfg)
+	if err = sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for key := range nodes.puts {
+		val, err := db.Get([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, _ := keccakCid(MEthStateTrie, val)
+		if !hasBlock(t, ipfs, c) {
+			t.Fatalf("the node %x was not imported", key)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+
+	cid "github.com/ipfs/go-cid"
+	metrics "github.com/ipfs/go-ipld-eth-import/metrics"
+)
+
+// VerifyStateTrie walks the DAG of a state trie imported into the
+// blockstore, from the given root CID, checking that all its blocks are
+// there. The state trie nodes are parsed with the eth-state-trie parser
+// to follow their links. The rest of linked blocks, i.e. storage tries
+// and EVM codes, are checked, but not walked.
+// The CID of every missing block is written into w, one per line, as
+// nothing under it can be walked. The present and missing blocks are
+// counted in "verify-ipfs-present-blocks" and "verify-ipfs-missing-blocks".
+func (m *IPFS) VerifyStateTrie(root string, w io.Writer) error {
+	rootCid, err := cid.Decode(root)
+	if err != nil {
+		return fmt.Errorf("wrong state root CID %s: %v", root, err)
+	}
+
+	metrics.NewCounter("verify-ipfs-present-blocks")
+	metrics.NewCounter("verify-ipfs-missing-blocks")
+	metrics.NewLogger("verify-ipfs-blocks")
+
+	// A trie is only as deep as its paths, so
+	// we can keep the pending blocks in memory
+	pending := []*cid.Cid{rootCid}
+	for len(pending) > 0 {
+		c := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		links, err := m.verifyBlock(c, w)
+		if err != nil {
+			return fmt.Errorf("block %s: %v", c, err)
+		}
+		pending = append(pending, links...)
+	}
+
+	return nil
+}
+
+// verifyBlock checks that the block of the given CID is in the
+// blockstore, returning the CIDs it links to, if it is a state
+// trie node. A missing block is written into w.
+func (m *IPFS) verifyBlock(c *cid.Cid, w io.Writer) ([]*cid.Cid, error) {
+	_l := metrics.StartLogDiff("verify-ipfs-blocks")
+	defer metrics.StopLogDiff("verify-ipfs-blocks", _l)
+
+	has, err := m.n.Blockstore.Has(c)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		metrics.IncCounter("verify-ipfs-missing-blocks")
+		_, err = fmt.Fprintln(w, c.String())
+		return nil, err
+	}
+
+	metrics.IncCounter("verify-ipfs-present-blocks")
+	fmt.Printf("%d\r", metrics.GetCounter("verify-ipfs-present-blocks"))
+
+	if c.Type() != MEthStateTrie {
+		return nil, nil
+	}
+
+	block, err := m.n.Blockstore.Get(c)
+	if err != nil {
+		return nil, err
+	}
+	nd, err := parseRawNode(block.RawData(), "eth-state-trie")
+	if err != nil {
+		return nil, err
+	}
+
+	var links []*cid.Cid
+	for _, link := range nd.Links() {
+		links = append(links, link.Cid)
+	}
+
+	return links, nil
+}
@@ -0,0 +1,108 @@
+package lib
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	cid "github.com/ipfs/go-cid"
+	metrics "github.com/ipfs/go-ipld-eth-import/metrics"
+)
+
+// verifyIPFS verifies the state trie of the given root CID, returning
+// the CIDs of the missing state trie nodes and the present blocks.
+// The rest of the missing blocks, i.e. the storage tries and EVM
+// codes not imported, are not returned.
+func verifyIPFS(t *testing.T, ipfs *IPFS, root *cid.Cid) ([]string, int) {
+	present := metrics.GetCounter("verify-ipfs-present-blocks")
+
+	var buf bytes.Buffer
+	if err := ipfs.VerifyStateTrie(root.String(), &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var missing []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		c, err := cid.Decode(line)
+		if err != nil {
+			t.Fatalf("wrong missing block %q: %v", line, err)
+		}
+		if c.Type() == MEthStateTrie {
+			missing = append(missing, line)
+		}
+	}
+
+	return missing, metrics.GetCounter("verify-ipfs-present-blocks") - present
+}
+
+func TestVerifyStateTrie(t *testing.T) {
+	db, cleanDB := newFixtureDB(t, 400)
+	defer cleanDB()
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+	ipfs, closeIPFS := newMemoryIPFS(t)
+	defer closeIPFS()
+
+	// Import the state trie, counting its nodes
+	nodes := &memorySink{puts: make(map[string]int)}
+	cfg := fixtureConfig(dir, "state-trie")
+	cfg.Sink = nodes
+	traverse(t, db, cfg)
+	sink, err := NewIPFSSink(ipfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Sink = sink
+	traverse(t, db, cfg)
+	if err = sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stateRoot, err := db.GetStateRoot(fixtureBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := db.Get(stateRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCid, _ := keccakCid(MEthStateTrie, val)
+
+	if err = ipfs.VerifyStateTrie("not a cid", &bytes.Buffer{}); err == nil {
+		t.Fatal("verified a wrong CID")
+	}
+
+	missing, present := verifyIPFS(t, ipfs, rootCid)
+	if len(missing) != 0 {
+		t.Fatalf("got missing state trie nodes %v", missing)
+	}
+	if present != len(nodes.puts) {
+		t.Fatalf("got %d present blocks, want %d", present, len(nodes.puts))
+	}
+
+	// Take out a child of the root, which is reported,
+	// and nothing under it is walked
+	root, err := DecodeTrieNode(val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := db.Get(root.(*Branch).Child(3).Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	childCid, _ := keccakCid(MEthStateTrie, child)
+	if err = ipfs.n.Blockstore.DeleteBlock(childCid); err != nil {
+		t.Fatal(err)
+	}
+
+	missing, afterDelete := verifyIPFS(t, ipfs, rootCid)
+	if len(missing) != 1 || missing[0] != childCid.String() {
+		t.Fatalf("got missing state trie nodes %v, want %s", missing, childCid)
+	}
+	if afterDelete >= present-1 {
+		t.Fatalf("got %d present blocks, the ones under the missing node were walked", afterDelete)
+	}
+}
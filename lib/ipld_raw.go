@@ -7,8 +7,35 @@ import (
 	node "github.com/ipfs/go-ipld-format"
 )
 
-// IpldRawNode allows us to import a 0x55 element by
-// complying with the IPLD format interface.
+const (
+	// MRawData is the cid codec for raw binary data.
+	MRawData = 0x55
+
+	// MEthBlock is the cid codec for an Ethereum Block Header.
+	MEthBlock = 0x90
+
+	// MEthBlockList is the cid codec for a list of Ethereum Block Headers,
+	// i.e. the ommers of a block.
+	MEthBlockList = 0x91
+
+	// MEthTxTrie is the cid codec for an Ethereum Transaction Trie node.
+	MEthTxTrie = 0x92
+
+	// MEthTx is the cid codec for an Ethereum Transaction.
+	MEthTx = 0x93
+
+	// MEthTxReceiptTrie is the cid codec for an Ethereum Receipt Trie node.
+	MEthTxReceiptTrie = 0x94
+
+	// MEthTxReceipt is the cid codec for an Ethereum Receipt.
+	MEthTxReceipt = 0x95
+
+	// MEthStorageTrie is the cid codec for an Ethereum Storage Trie node.
+	MEthStorageTrie = 0x98
+)
+
+// IpldRawNode allows us to import a 0x55 element (or any other codec
+// we do not need to resolve) by complying with the IPLD format interface.
 type IpldRawNode struct {
 	cid     *cid.Cid
 	rawdata []byte
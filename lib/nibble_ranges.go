@@ -0,0 +1,102 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// nibbleRange is a range of paths of the same length, given as
+// nibbles. A single path prefix is a range with lo equal to hi.
+type nibbleRange struct {
+	lo []byte
+	hi []byte
+}
+
+// parseNibbleRanges parses a comma separated list of hex path prefixes
+// (ex: "2a7") and ranges of them (ex: "2a0-2af"). Both ends of a range
+// must have the same length.
+func parseNibbleRanges(s string) ([]nibbleRange, error) {
+	var out []nibbleRange
+
+	if s == "" {
+		return nil, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		ends := strings.Split(part, "-")
+		switch len(ends) {
+		case 1:
+			prefix, err := hexToNibbles(ends[0])
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, nibbleRange{lo: prefix, hi: prefix})
+		case 2:
+			lo, err := hexToNibbles(ends[0])
+			if err != nil {
+				return nil, err
+			}
+			hi, err := hexToNibbles(ends[1])
+			if err != nil {
+				return nil, err
+			}
+			if len(lo) != len(hi) {
+				return nil, fmt.Errorf("both ends of the nibble range %s must have the same length", part)
+			}
+			if bytes.Compare(lo, hi) > 0 {
+				return nil, fmt.Errorf("wrong nibble range %s, its start is greater than its end", part)
+			}
+			out = append(out, nibbleRange{lo: lo, hi: hi})
+		default:
+			return nil, fmt.Errorf("wrong nibble range %s", part)
+		}
+	}
+
+	return out, nil
+}
+
+// hexToNibbles converts a string of hex characters into nibbles.
+func hexToNibbles(s string) ([]byte, error) {
+	if s == "" {
+		return nil, errors.New("empty nibble prefix")
+	}
+
+	out := make([]byte, len(s))
+	for idx := 0; idx < len(s); idx++ {
+		n := s[idx]
+		switch {
+		case n >= '0' && n <= '9':
+			out[idx] = n - '0'
+		case n >= 'a' && n <= 'f':
+			out[idx] = n + 10 - 'a'
+		default:
+			return nil, fmt.Errorf("wrong value for nibble: %c", n)
+		}
+	}
+
+	return out, nil
+}
+
+// matchesNibbleRanges tells whether the given path can lead to a path
+// in any of the ranges. If the path is shorter than a range, it is enough
+// for it to be the prefix of one of its paths. If there are no ranges,
+// every path matches.
+func matchesNibbleRanges(ranges []nibbleRange, path []byte) bool {
+	if len(ranges) == 0 {
+		return true
+	}
+
+	for _, r := range ranges {
+		n := len(r.lo)
+		if len(path) < n {
+			n = len(path)
+		}
+		if bytes.Compare(path[:n], r.lo[:n]) >= 0 && bytes.Compare(path[:n], r.hi[:n]) <= 0 {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,103 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNibbleRanges(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []nibbleRange
+	}{
+		{"", nil},
+		{"2", []nibbleRange{{lo: []byte{2}, hi: []byte{2}}}},
+		{"2a7", []nibbleRange{{lo: []byte{2, 0xa, 7}, hi: []byte{2, 0xa, 7}}}},
+		{"1f-21", []nibbleRange{{lo: []byte{1, 0xf}, hi: []byte{2, 1}}}},
+		{"3,2a0-2af", []nibbleRange{
+			{lo: []byte{3}, hi: []byte{3}},
+			{lo: []byte{2, 0xa, 0}, hi: []byte{2, 0xa, 0xf}},
+		}},
+	} {
+		got, err := parseNibbleRanges(tc.in)
+		if err != nil {
+			t.Errorf("%q: %v", tc.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %v, want %v", tc.in, got, tc.want)
+		}
+	}
+
+	for _, in := range []string{
+		"1-21",  // ends of different lengths
+		"21-1f", // start greater than the end
+		"1-2-3",
+		"2g",
+		"2A",
+		"2,",
+		"-2",
+	} {
+		if _, err := parseNibbleRanges(in); err == nil {
+			t.Errorf("%q: no error", in)
+		}
+	}
+}
+
+func TestMatchesNibbleRanges(t *testing.T) {
+	for _, tc := range []struct {
+		ranges string
+		path   string
+		want   bool
+	}{
+		{"", "", true},
+		{"", "7", true},
+
+		// Paths shorter than the ranges lead to them if they are their prefixes
+		{"2a7", "", true},
+		{"2a7", "2", true},
+		{"2a7", "2a", true},
+		{"2a7", "2b", false},
+		{"2a7", "3", false},
+
+		// Paths as long as the ranges, or longer
+		{"2a7", "2a7", true},
+		{"2a7", "2a70f", true},
+		{"2a7", "2a8", false},
+		{"2a7", "2a6f", false},
+
+		// A range crossing a nibble
+		{"1f-21", "1", true},
+		{"1f-21", "2", true},
+		{"1f-21", "0", false},
+		{"1f-21", "3", false},
+		{"1f-21", "1e", false},
+		{"1f-21", "1f", true},
+		{"1f-21", "20", true},
+		{"1f-21", "21", true},
+		{"1f-21", "22", false},
+		{"1f-21", "1fff", true},
+		{"1f-21", "21ff", true},
+		{"1f-21", "10ff", false},
+
+		// Several ranges
+		{"3,2a0-2af", "3c", true},
+		{"3,2a0-2af", "2a5", true},
+		{"3,2a0-2af", "2b", false},
+		{"3,2a0-2af", "4", false},
+	} {
+		ranges, err := parseNibbleRanges(tc.ranges)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var path []byte
+		if tc.path != "" {
+			if path, err = hexToNibbles(tc.path); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := matchesNibbleRanges(ranges, path); got != tc.want {
+			t.Errorf("%q matching %q: got %v, want %v", tc.path, tc.ranges, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// pathsIndexBufferSize is the size of the lines kept in memory
+// before writing them into the paths index.
+const pathsIndexBufferSize = 64 * 1024
+
+// pathsIndex writes down where every exported trie node is found, as
+// lines of "<node hash> <state|storage> <account hash|-> <path>",
+// with the path as hex nibbles. The path of a leaf is completed with
+// the nibbles it holds, being its full key, i.e. the hash of an
+// account or a storage slot.
+// The shards of a TriePool append to the same file, so the lines
+// are written in whole, with the file opened in append mode.
+// A traversal starting afresh empties the file, and a resumed one
+// drops what was written after its checkpoint, as it is written again.
+type pathsIndex struct {
+	file *os.File
+	buf  bytes.Buffer
+}
+
+// openPathsIndex opens the given file to append lines to it, truncated
+// to the given size, i.e. zero, or its size at the checkpoint we resume
+// from. A negative size leaves it as it is, for the shards of a TriePool,
+// as the pool truncates it for all of them.
+func openPathsIndex(path string, size int64) (*pathsIndex, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if size >= 0 {
+		if err = file.Truncate(size); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	return &pathsIndex{file: file}, nil
+}
+
+// truncatePathsIndex truncates the given file to the given size,
+// creating it if it does not exist.
+func truncatePathsIndex(path string, size int64) error {
+	pi, err := openPathsIndex(path, size)
+	if err != nil {
+		return err
+	}
+
+	return pi.close()
+}
+
+// add writes down the given node. The leaf path is nil
+// if the node is not a leaf.
+func (pi *pathsIndex) add(item *stackItem, leafPath []byte) error {
+	return pi.addLine("", item.key, item, leafPath)
+}
+
+// addProblem writes down the problem found in the given block with the
+// given key of the given node, i.e. its hash, or the hash of the EVM code
+// of its account, with a line starting with the problem and the block.
+func (pi *pathsIndex) addProblem(problem string, block uint64, key []byte, item *stackItem, leafPath []byte) error {
+	return pi.addLine(fmt.Sprintf("%s %d ", problem, block), key, item, leafPath)
+}
+
+// addLine writes down the line of the given key of the given node,
+// after the given prefix.
+func (pi *pathsIndex) addLine(prefix string, key []byte, item *stackItem, leafPath []byte) error {
+	trie, account := "state", "-"
+	if item.trie == storageTrie {
+		trie, account = "storage", fmt.Sprintf("%x", item.account)
+	}
+
+	fmt.Fprintf(&pi.buf, "%s%x %s %s ", prefix, key, trie, account)
+	for _, n := range item.childPath(leafPath) {
+		fmt.Fprintf(&pi.buf, "%x", n)
+	}
+	pi.buf.WriteByte('\n')
+
+	if pi.buf.Len() >= pathsIndexBufferSize {
+		return pi.flush()
+	}
+	return nil
+}
+
+// flush writes the lines kept in memory into the file.
+func (pi *pathsIndex) flush() error {
+	if pi.buf.Len() == 0 {
+		return nil
+	}
+
+	_, err := pi.file.Write(pi.buf.Bytes())
+	pi.buf.Reset()
+	return err
+}
+
+// flushedSize writes the lines kept in memory, returning the size of
+// the file then. For a shard, it counts what the rest of them wrote.
+func (pi *pathsIndex) flushedSize() (int64, error) {
+	if err := pi.flush(); err != nil {
+		return 0, err
+	}
+
+	info, err := pi.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// close writes what is left in memory, and closes the file.
+func (pi *pathsIndex) close() error {
+	err := pi.flush()
+	if cerr := pi.file.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
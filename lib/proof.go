@@ -0,0 +1,182 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+
+	common "github.com/ethereum/go-ethereum/common"
+	hexutil "github.com/ethereum/go-ethereum/common/hexutil"
+	crypto "github.com/ethereum/go-ethereum/crypto"
+)
+
+// Proof is the Merkle proof of an account, and of some of its storage
+// slots, in the state trie of a block, in the fashion of EIP-1186
+// (eth_getProof). Next to the RLP of every node of the proof, we give
+// its CID, so the nodes can be fetched from IPFS.
+// If the account does not exist, its proof is the path leading to
+// where it should be, and its fields are the ones of an empty account.
+type Proof struct {
+	Address      hexutil.Bytes  `json:"address"`
+	AccountProof []ProofNode    `json:"accountProof"`
+	Balance      *hexutil.Big   `json:"balance"`
+	CodeHash     hexutil.Bytes  `json:"codeHash"`
+	Nonce        hexutil.Uint64 `json:"nonce"`
+	StorageHash  hexutil.Bytes  `json:"storageHash"`
+	StorageProof []StorageProof `json:"storageProof"`
+}
+
+// StorageProof is the Merkle proof of a storage slot, from the
+// storage root of its account. The value of a missing slot is zero.
+type StorageProof struct {
+	Key   hexutil.Bytes `json:"key"`
+	Value *hexutil.Big  `json:"value"`
+	Proof []ProofNode   `json:"proof"`
+}
+
+// ProofNode is a trie node of a proof: its RLP, and its CID.
+type ProofNode struct {
+	RLP hexutil.Bytes `json:"rlp"`
+	Cid string        `json:"cid"`
+}
+
+// GetProof returns the proof of the account of the given address in
+// the state trie of the block of the given number, along with the ones
+// of the given storage slots of it. The storage keys are the positions
+// of the slots, not their hashes.
+func GetProof(db *GethDB, blockNumber uint64, address []byte, storageKeys [][]byte) (*Proof, error) {
+	if len(address) != common.AddressLength {
+		return nil, fmt.Errorf("wrong address %x", address)
+	}
+
+	stateRoot, err := db.GetStateRoot(blockNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	addressHash := crypto.Keccak256(address)
+	nodes, leaf, leafKey, err := proveKey(db, stateRoot, addressHash, MEthStateTrie)
+	if err != nil {
+		return nil, err
+	}
+
+	proof := &Proof{
+		Address:      address,
+		AccountProof: nodes,
+		Balance:      (*hexutil.Big)(new(big.Int)),
+		CodeHash:     emptyCodeHash,
+		StorageHash:  emptyRoot[:],
+		StorageProof: []StorageProof{},
+	}
+
+	if leaf != nil {
+		account, err := leaf.Account(addressHash)
+		if err != nil {
+			return nil, withKey(err, leafKey)
+		}
+
+		proof.Nonce = hexutil.Uint64(account.Nonce)
+		proof.Balance = (*hexutil.Big)(account.Balance)
+		proof.StorageHash = account.StorageRoot
+		proof.CodeHash = account.CodeHash
+	}
+
+	for _, storageKey := range storageKeys {
+		if len(storageKey) > 32 {
+			return nil, fmt.Errorf("wrong storage key %x", storageKey)
+		}
+		slot := common.LeftPadBytes(storageKey, 32)
+
+		nodes, leaf, leafKey, err := proveKey(db, proof.StorageHash, crypto.Keccak256(slot), MEthStorageTrie)
+		if err != nil {
+			return nil, &StorageSlotError{Slot: slot, Err: err}
+		}
+
+		var value []byte
+		if leaf != nil {
+			value, err = leaf.SlotValue()
+			if err != nil {
+				return nil, &StorageSlotError{Slot: slot, Err: withKey(err, leafKey)}
+			}
+		}
+
+		proof.StorageProof = append(proof.StorageProof, StorageProof{
+			Key:   slot,
+			Value: (*hexutil.Big)(new(big.Int).SetBytes(value)),
+			Proof: nodes,
+		})
+	}
+
+	return proof, nil
+}
+
+// proveKey walks the trie of the given root down the path of the given
+// key, returning the nodes found on the way, and the leaf of the key,
+// or nil if the key is not in the trie, along with the key of the node
+// the leaf was found in, i.e. its parent if it is embedded.
+// Embedded nodes are already part of the RLP of their parents.
+func proveKey(db *GethDB, root, key []byte, codec uint64) ([]ProofNode, *Leaf, []byte, error) {
+	nodes := []ProofNode{}
+	if bytes.Equal(root, emptyRoot[:]) {
+		return nodes, nil, nil, nil
+	}
+
+	path := bytesToNibbles(key)
+	nodeKey := root
+	var rawVal []byte
+
+	for {
+		if rawVal == nil {
+			val, err := db.Get(nodeKey)
+			if err != nil {
+				return nil, nil, nil, withKey(err, nodeKey)
+			}
+			c, err := keccakCid(codec, val)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			nodes = append(nodes, ProofNode{RLP: val, Cid: c.String()})
+			rawVal = val
+		}
+
+		decoded, err := DecodeTrieNode(rawVal)
+		if err != nil {
+			return nil, nil, nil, withKey(err, nodeKey)
+		}
+
+		var child *TrieNodeChild
+		switch n := decoded.(type) {
+		case *Leaf:
+			// Another key sharing the path means ours is missing
+			if !bytes.Equal(n.Path, path) {
+				return nodes, nil, nil, nil
+			}
+			return nodes, n, nodeKey, nil
+
+		case *Extension:
+			if !bytes.HasPrefix(path, n.Path) {
+				return nodes, nil, nil, nil
+			}
+			path = path[len(n.Path):]
+			child = &n.Child
+
+		case *Branch:
+			if len(path) == 0 {
+				return nil, nil, nil, withKey(&UnknownNodeTypeError{Reason: "branch at the end of a full path"}, nodeKey)
+			}
+			child = n.Child(path[0])
+			path = path[1:]
+		}
+		if child == nil {
+			return nodes, nil, nil, nil
+		}
+
+		// An embedded child is decoded from the RLP of its parent
+		if child.Embedded != nil {
+			rawVal = child.Embedded
+			continue
+		}
+		nodeKey = child.Key
+		rawVal = nil
+	}
+}
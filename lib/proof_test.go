@@ -0,0 +1,233 @@
+package lib
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	common "github.com/ethereum/go-ethereum/common"
+	crypto "github.com/ethereum/go-ethereum/crypto"
+	trie "github.com/ethereum/go-ethereum/trie"
+)
+
+func TestGetProofOfCorruptAccount(t *testing.T) {
+	address := fixtureAddress(0)
+	db, cleanDB := newCustomFixtureDB(t, func(w fixtureWriter, state *trie.Trie) {
+		for idx := 1; idx < 50; idx++ {
+			state.Update(crypto.Keccak256(fixtureAddress(idx)), fixtureAccount(uint64(idx), emptyRoot, common.BytesToHash(emptyCodeHash)))
+		}
+		// A leaf whose value is not an account
+		state.Update(crypto.Keccak256(address), bytes.Repeat([]byte{0x01}, 40))
+	})
+	defer cleanDB()
+
+	_, err := GetProof(db, fixtureBlock, address, nil)
+	corrupt, ok := err.(*CorruptRLPError)
+	if !ok {
+		t.Fatalf("got %T (%v), want a *CorruptRLPError", err, err)
+	}
+	if corrupt.Err == nil || corrupt.Key == nil {
+		t.Fatalf("got %+v, want the cause and the key of the leaf", corrupt)
+	}
+	val, err := db.Get(corrupt.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(val, bytes.Repeat([]byte{0x01}, 40)) {
+		t.Fatalf("the key %x is not the one of the leaf", corrupt.Key)
+	}
+}
+
+// proofDB lets trie.VerifyProof read the nodes of a proof.
+type proofDB map[string][]byte
+
+func newProofDB(nodes []ProofNode) proofDB {
+	db := make(proofDB)
+	for _, node := range nodes {
+		db[string(crypto.Keccak256(node.RLP))] = node.RLP
+	}
+	return db
+}
+
+func (db proofDB) Get(key []byte) ([]byte, error) { return db[string(key)], nil }
+
+func (db proofDB) Has(key []byte) (bool, error) { return db[string(key)] != nil, nil }
+
+// verifyProof checks the given proof of the given key against the root
+// with go-ethereum, returning the value it proves, nil if the key is
+// absent. Every node of the proof must be needed.
+func verifyProof(t *testing.T, root common.Hash, key []byte, nodes []ProofNode) []byte {
+	value, err, used := trie.VerifyProof(root, key, newProofDB(nodes))
+	if err != nil {
+		t.Fatalf("key %x: %v", key, err)
+	}
+	// A proof of absence ends with the node lacking the key
+	if value == nil {
+		used++
+	}
+	if used != len(nodes) {
+		t.Fatalf("key %x: %d nodes of %d are used", key, used, len(nodes))
+	}
+
+	return value
+}
+
+func TestGetProof(t *testing.T) {
+	db, cleanDB := newFixtureDB(t, 400)
+	defer cleanDB()
+
+	stateRoot, err := db.GetStateRoot(fixtureBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Present accounts, with and without storage, and absent ones
+	for _, idx := range []int{0, 1, 2, 3, 7, 199, 399, 400, 401, 1000} {
+		address := fixtureAddress(idx)
+		slots := [][]byte{{0}, {1}, {2}, {3}, {4}, {5}, {6}, {7}, {0x01, 0x00}}
+		proof, err := GetProof(db, fixtureBlock, address, slots)
+		if err != nil {
+			t.Fatalf("account %d: %v", idx, err)
+		}
+
+		value := verifyProof(t, common.BytesToHash(stateRoot), crypto.Keccak256(address), proof.AccountProof)
+		if idx >= 400 {
+			if value != nil || proof.Nonce != 0 || proof.Balance.ToInt().Sign() != 0 ||
+				!bytes.Equal(proof.StorageHash, emptyRoot[:]) || !bytes.Equal(proof.CodeHash, emptyCodeHash) {
+				t.Errorf("account %d: the absent account is proved as %+v", idx, proof)
+			}
+			continue
+		}
+
+		if !bytes.Equal(value, fixtureAccount(uint64(proof.Nonce), common.BytesToHash(proof.StorageHash), common.BytesToHash(proof.CodeHash))) {
+			t.Errorf("account %d: the proof gives the account %x", idx, value)
+		}
+		if uint64(proof.Nonce) != uint64(idx) || proof.Balance.ToInt().Int64() != int64(1000*idx) {
+			t.Errorf("account %d: wrong nonce %d or balance %v", idx, proof.Nonce, proof.Balance.ToInt())
+		}
+
+		// The contracts have the slots up to idx%7, with the values
+		// of their positions plus one
+		for _, slotProof := range proof.StorageProof {
+			position := new(big.Int).SetBytes(slotProof.Key).Int64()
+			var want int64
+			if idx%3 == 0 && position <= int64(idx%7) {
+				want = position + 1
+			}
+			if slotProof.Value.ToInt().Int64() != want {
+				t.Errorf("account %d, slot %d: got the value %v, want %d", idx, position, slotProof.Value.ToInt(), want)
+			}
+			if bytes.Equal(proof.StorageHash, emptyRoot[:]) {
+				if len(slotProof.Proof) != 0 {
+					t.Errorf("account %d, slot %d: a proof in an empty storage trie", idx, position)
+				}
+				continue
+			}
+
+			value := verifyProof(t, common.BytesToHash(proof.StorageHash), crypto.Keccak256(slotProof.Key), slotProof.Proof)
+			if (value != nil) != (want != 0) {
+				t.Errorf("account %d, slot %d: the proof gives the value %x", idx, position, value)
+			}
+		}
+	}
+}
+
+// newTrieDB writes a trie with the given keys and values, without
+// hashing the keys, into a fixture database, returning its root.
+func newTrieDB(t *testing.T, entries map[string]string) (*GethDB, common.Hash, func()) {
+	var root common.Hash
+	db, cleanDB := newCustomFixtureDB(t, func(w fixtureWriter, state *trie.Trie) {
+		tr, _ := trie.New(common.Hash{}, nil)
+		for key, value := range entries {
+			tr.Update([]byte(key), []byte(value))
+		}
+		var err error
+		if root, err = tr.CommitTo(w); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	return db, root, cleanDB
+}
+
+func TestProveKey(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		entries map[string]string
+		present []string
+		absent  []string
+	}{
+		{
+			// Short keys and values make every node but the root embedded
+			name:    "embedded nodes",
+			entries: map[string]string{"\x01\x01": "a", "\x01\x02": "b", "\x01\x03": "c", "\x02\x01": "d"},
+			present: []string{"\x01\x01", "\x01\x03", "\x02\x01"},
+			absent: []string{
+				"\x01\x04", // a branch without the child
+				"\x03\x00", // the root without the child
+				"\x02\x02", // a leaf of another key
+			},
+		},
+		{
+			name: "hashed nodes",
+			entries: map[string]string{
+				"\xaa\xb1": string(bytes.Repeat([]byte("x"), 40)),
+				"\xaa\xb2": string(bytes.Repeat([]byte("y"), 40)),
+				"\xaa\xc1": string(bytes.Repeat([]byte("z"), 40)),
+			},
+			present: []string{"\xaa\xb1", "\xaa\xb2", "\xaa\xc1"},
+			absent: []string{
+				"\xab\x00", // the extension at the root, diverging
+				"\xaa\xb3", // a branch without the child
+				"\xaa\xc2", // a leaf of another key
+			},
+		},
+		{
+			name:    "a single leaf",
+			entries: map[string]string{"\x10\x20": string(bytes.Repeat([]byte("v"), 40))},
+			present: []string{"\x10\x20"},
+			absent:  []string{"\x10\x21", "\x00\x00"},
+		},
+	} {
+		db, root, cleanDB := newTrieDB(t, tc.entries)
+
+		for _, key := range append(tc.present, tc.absent...) {
+			nodes, leaf, leafKey, err := proveKey(db, root[:], []byte(key), MEthStateTrie)
+			if err != nil {
+				t.Fatalf("%s, key %x: %v", tc.name, key, err)
+			}
+			value := verifyProof(t, root, []byte(key), nodes)
+
+			want, present := tc.entries[key]
+			if present != (leaf != nil) || string(value) != want {
+				t.Errorf("%s, key %x: got the value %q, want %q", tc.name, key, value, want)
+			}
+			if leaf != nil && string(leaf.Value) != want {
+				t.Errorf("%s, key %x: got the leaf %q, want %q", tc.name, key, leaf.Value, want)
+			}
+			if leaf != nil {
+				if _, err := db.Get(leafKey); err != nil {
+					t.Errorf("%s, key %x: the key of the leaf: %v", tc.name, key, err)
+				}
+			}
+		}
+
+		cleanDB()
+	}
+}
+
+func TestProveKeyOfBranchValue(t *testing.T) {
+	// A key being the prefix of another ends at a branch, which
+	// never happens in the tries of Ethereum, as their keys are hashes
+	db, root, cleanDB := newTrieDB(t, map[string]string{
+		"do":  string(bytes.Repeat([]byte("v"), 40)),
+		"dog": string(bytes.Repeat([]byte("p"), 40)),
+		"dot": string(bytes.Repeat([]byte("t"), 40)),
+	})
+	defer cleanDB()
+
+	_, _, _, err := proveKey(db, root[:], []byte("do"), MEthStateTrie)
+	if _, ok := err.(*UnknownNodeTypeError); !ok {
+		t.Fatalf("got %T (%v), want an *UnknownNodeTypeError", err, err)
+	}
+}
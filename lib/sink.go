@@ -0,0 +1,274 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+	metrics "github.com/ipfs/go-ipld-eth-import/metrics"
+)
+
+// Sink is where a traversal puts the trie nodes, and the EVM codes, it
+// exports. The shards of a TriePool share the same sink, so it must be
+// safe to use from several goroutines. The traversal does not close it,
+// whoever creates it does, once done.
+type Sink interface {
+	// Put writes the given value of the given key. The format tells
+	// what it is, as given to DagPut: "eth-state-trie", "eth-storage-trie",
+	// or "importer-ipld-raw-data" for the EVM codes. The account is the
+	// hash of the one owning a storage trie node, nil otherwise.
+	Put(key, account, value []byte, format string) error
+
+	// Flush makes what was put so far durable. The traversal calls it
+	// on every checkpoint, so it can be resumed from there.
+	Flush() error
+
+	// Close flushes the sink, and releases it.
+	Close() error
+}
+
+// Static checks
+var (
+	_ Sink = (*FileSink)(nil)
+	_ Sink = (*IPFSSink)(nil)
+	_ Sink = (*CARSink)(nil)
+	_ Sink = (*CountSink)(nil)
+)
+
+// FileSink stores every value into a file named after its key, under
+// the dump directory, as in dumpDir/xx/yy/zz/<key>. Storage trie nodes
+// go into the subdirectory of their account.
+type FileSink struct {
+	dumpDir string
+}
+
+// NewFileSink returns a FileSink dumping into the given directory.
+func NewFileSink(dumpDir string) *FileSink {
+	metrics.NewLogger("file-creations")
+
+	return &FileSink{dumpDir: dumpDir}
+}
+
+// Put stores the value into its file.
+func (fs *FileSink) Put(key, account, value []byte, format string) error {
+	dumpDir := fs.dumpDir
+	if account != nil {
+		dumpDir = filepath.Join(dumpDir, fmt.Sprintf("%x", account))
+	}
+
+	return storeFile(dumpDir, key, value)
+}
+
+// Flush does nothing, every file is written at once.
+func (fs *FileSink) Flush() error {
+	return nil
+}
+
+// Close does nothing, every file is written at once.
+func (fs *FileSink) Close() error {
+	return nil
+}
+
+// IPFSSink imports every value into IPFS, as an IPLD block of its
+// format, committing them in batches. Every checkpoint of a traversal
+// commits the batch, and a resumed traversal goes back to the stack of
+// its last checkpoint, so the blocks of a batch lost in a crash are
+// imported again.
+type IPFSSink struct {
+	lock  sync.Mutex
+	batch *ImportBatch
+}
+
+// NewIPFSSink returns an IPFSSink importing into the given IPFS node.
+func NewIPFSSink(ipfs *IPFS) (*IPFSSink, error) {
+	metrics.NewLogger("ipfs-dag-put")
+	metrics.NewLogger("bytes-tranferred")
+
+	batch, err := ipfs.NewImportBatch(importBatchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IPFSSink{batch: batch}, nil
+}
+
+// Put adds the value to the batch, committing it if full.
+func (is *IPFSSink) Put(key, account, value []byte, format string) error {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	return importIntoIPFS(is.batch, value, format)
+}
+
+// Flush commits what is left in the batch.
+func (is *IPFSSink) Flush() error {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	return is.batch.Flush()
+}
+
+// Close commits what is left in the batch.
+func (is *IPFSSink) Close() error {
+	return is.Flush()
+}
+
+// CARSink writes every value into a CARv1 file, as an IPLD block of
+// its format. The size of the file at its last flush is kept next to
+// it, in <path>.size, to resume an interrupted export from there.
+// Every checkpoint of a traversal flushes it, and a resumed traversal
+// goes back to the stack of its last checkpoint, so the blocks dropped
+// are written again. The ones written between the flush and the
+// checkpoint itself may end up twice in the file, as CARv1 allows.
+// The file is not touched until the first block is written, or the sink
+// is flushed, so a traversal refusing to start, as another process is
+// using its stack directory, leaves the file of that one alone.
+type CARSink struct {
+	lock   sync.Mutex
+	path   string
+	root   *cid.Cid
+	offset int64
+	car    *carWriter
+}
+
+// NewCARSink returns the sink of the CAR file whose root is the block of
+// the given format and keccak256 hash, i.e. a state root. If we resume a
+// previous export, its file is written from its last flush on.
+func NewCARSink(path, rootFormat string, root []byte, resume bool) (*CARSink, error) {
+	metrics.NewLogger("car-writes")
+	metrics.NewLogger("bytes-tranferred")
+
+	codec, ok := formatCodecs[rootFormat]
+	if !ok {
+		return nil, fmt.Errorf("unknown format %s", rootFormat)
+	}
+	rootCid, err := keyCid(codec, root)
+	if err != nil {
+		return nil, err
+	}
+
+	var offset int64
+	if resume {
+		data, err := ioutil.ReadFile(path + ".size")
+		if err != nil {
+			return nil, fmt.Errorf("the CAR file to resume is unknown: %v", err)
+		}
+		offset, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("the CAR file to resume is unknown: %v", err)
+		}
+	}
+
+	return &CARSink{path: path, root: rootCid, offset: offset}, nil
+}
+
+// open creates the CAR file, or goes back to its last flush,
+// the first time we need it.
+func (cs *CARSink) open() error {
+	if cs.car != nil {
+		return nil
+	}
+
+	car, err := createCAR(cs.path, cs.root, cs.offset)
+	if err != nil {
+		return err
+	}
+	cs.car = car
+
+	return nil
+}
+
+// Put writes the value as a block of the CAR file.
+func (cs *CARSink) Put(key, account, value []byte, format string) error {
+	codec, ok := formatCodecs[format]
+	if !ok {
+		return fmt.Errorf("unknown format %s", format)
+	}
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	if err := cs.open(); err != nil {
+		return err
+	}
+	return writeIntoCAR(cs.car, codec, value)
+}
+
+// Flush writes the blocks kept in memory into the file,
+// and then, its size.
+func (cs *CARSink) Flush() error {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	err := cs.open()
+	if err != nil {
+		return err
+	}
+	err = cs.car.flush()
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(cs.path+".size", []byte(strconv.FormatInt(cs.car.size, 10)), 0644)
+}
+
+// RootWritten tells whether the block of the root was written into the
+// file. A resumed export only knows about the blocks written since then.
+func (cs *CARSink) RootWritten() bool {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	return cs.car != nil && cs.car.rootWritten
+}
+
+// Close flushes the file, and closes it. If it was never
+// written to, nor flushed, it is left as it is.
+func (cs *CARSink) Close() error {
+	cs.lock.Lock()
+	opened := cs.car != nil
+	cs.lock.Unlock()
+	if !opened {
+		return nil
+	}
+
+	err := cs.Flush()
+	if cerr := cs.car.file.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// CountSink puts the values nowhere, it only counts them,
+// in "sink-puts", and their bytes, in "sink-bytes".
+// It is there to measure a traversal without exporting anything.
+type CountSink struct{}
+
+// NewCountSink returns a CountSink.
+func NewCountSink() *CountSink {
+	metrics.NewCounter("sink-puts")
+	metrics.NewLogger("sink-bytes")
+
+	return &CountSink{}
+}
+
+// Put counts the value.
+func (cs *CountSink) Put(key, account, value []byte, format string) error {
+	metrics.IncCounter("sink-puts")
+	metrics.AddLog("sink-bytes", int64(len(value)))
+	return nil
+}
+
+// Flush does nothing.
+func (cs *CountSink) Flush() error {
+	return nil
+}
+
+// Close does nothing.
+func (cs *CountSink) Close() error {
+	return nil
+}
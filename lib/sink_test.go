@@ -0,0 +1,126 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	metrics "github.com/ipfs/go-ipld-eth-import/metrics"
+)
+
+func TestSinks(t *testing.T) {
+	db, cleanDB := newFixtureDB(t, 400)
+	defer cleanDB()
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	stateRoot, err := db.GetStateRoot(fixtureBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, operation := range []string{"state-trie", "storage-trie", "evmcode"} {
+		opDir := filepath.Join(dir, operation)
+		exportInto := func(sink Sink) {
+			cfg := fixtureConfig(opDir, operation)
+			cfg.Sink = sink
+			traverse(t, db, cfg)
+			if err := sink.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// What every sink is given
+		nodes := &memorySink{puts: make(map[string]int)}
+		exportInto(nodes)
+		var puts int
+		for _, count := range nodes.puts {
+			puts += count
+		}
+		if puts == 0 {
+			t.Fatalf("%s: nothing was put", operation)
+		}
+
+		// Every value is a file named after its key, and the storage
+		// trie nodes go into the directories of their accounts
+		dumpDir := filepath.Join(opDir, "dump")
+		exportInto(NewFileSink(dumpDir))
+		files := readDumpDir(t, dumpDir)
+		for key := range nodes.puts {
+			if _, ok := files[fmt.Sprintf("%x", key)]; !ok {
+				t.Fatalf("%s: the file of %x was not written", operation, key)
+			}
+		}
+		depth := 3
+		if operation == "storage-trie" {
+			depth = 4
+		}
+		var written int
+		filepath.Walk(dumpDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			written++
+			rel, _ := filepath.Rel(dumpDir, path)
+			if strings.Count(rel, string(filepath.Separator)) != depth {
+				t.Fatalf("%s: the file %s is not where it should be", operation, rel)
+			}
+			return nil
+		})
+		if written != puts {
+			t.Fatalf("%s: got %d files, want %d", operation, written, puts)
+		}
+
+		// Every value is a block of the CAR file
+		carPath := filepath.Join(opDir, "export.car")
+		car, err := NewCARSink(carPath, "eth-state-trie", stateRoot, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exportInto(car)
+		var blocks int
+		for _, count := range readCARBlocks(t, carPath) {
+			blocks += count
+		}
+		if blocks != puts {
+			t.Fatalf("%s: got %d blocks, want %d", operation, blocks, puts)
+		}
+		if car.RootWritten() != (operation == "state-trie") {
+			t.Fatalf("%s: RootWritten() is %v", operation, car.RootWritten())
+		}
+
+		// Every value is counted
+		counted := metrics.GetCounter("sink-puts")
+		exportInto(NewCountSink())
+		if got := metrics.GetCounter("sink-puts") - counted; got != puts {
+			t.Fatalf("%s: got %d counted puts, want %d", operation, got, puts)
+		}
+	}
+}
+
+func TestCARSinkOfUnknownFormat(t *testing.T) {
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	root := make([]byte, 32)
+	carPath := filepath.Join(dir, "export.car")
+	if _, err := NewCARSink(carPath, "eth-unknown", root, false); err == nil {
+		t.Fatal("got a CAR file of an unknown root format")
+	}
+
+	sink, err := NewCARSink(carPath, "eth-state-trie", root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Put(root, nil, []byte{0x80}, "eth-unknown"); err == nil {
+		t.Fatal("put a block of an unknown format")
+	}
+	if err = sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(carPath); !os.IsNotExist(err) {
+		t.Fatal("the CAR file was written with no blocks")
+	}
+}
@@ -0,0 +1,163 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// snapshotAccount is the line of an account in the snapshot.
+type snapshotAccount struct {
+	AddressHash string `json:"addressHash"`
+	Nonce       uint64 `json:"nonce"`
+	Balance     string `json:"balance"`
+	StorageRoot string `json:"storageRoot"`
+	CodeHash    string `json:"codeHash"`
+}
+
+// snapshotSlot is the line of a storage slot in the snapshot.
+// The slot is only known if geth kept the preimage of its hash.
+type snapshotSlot struct {
+	AddressHash string `json:"addressHash"`
+	SlotHash    string `json:"slotHash"`
+	Slot        string `json:"slot,omitempty"`
+	Value       string `json:"value"`
+}
+
+// snapshotHeaders are the CSV headers of the snapshot of every operation
+var snapshotHeaders = map[string]string{
+	"accounts":      "addressHash,nonce,balance,storageRoot,codeHash",
+	"storage-slots": "addressHash,slotHash,slot,value",
+}
+
+// snapshot writes the accounts or storage slots found in the traversal
+// into a file, one per line, as JSON or CSV. As the traversal goes
+// through the leaves of the state trie in the order of their keys,
+// the accounts are sorted by the hash of their address.
+type snapshot struct {
+	file   *os.File
+	w      *bufio.Writer
+	format string
+}
+
+// openSnapshot creates the snapshot file of the given format ("json"
+// or "csv"), with the given CSV header. If we resume, the file goes
+// back to the given size, the one it had at the checkpoint we resume
+// from, and the lines are written from there.
+func openSnapshot(path, format, header string, resume bool, size int64) (*snapshot, error) {
+	if path == "" {
+		return nil, errors.New("the snapshot needs a file to write to")
+	}
+	if format != "json" && format != "csv" {
+		return nil, fmt.Errorf("unsupported snapshot format %s", format)
+	}
+
+	if !resume {
+		size = 0
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = file.Truncate(size); err == nil {
+		_, err = file.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	as := &snapshot{
+		file:   file,
+		w:      bufio.NewWriter(file),
+		format: format,
+	}
+
+	if format == "csv" && !resume {
+		_, err = as.w.WriteString(header + "\n")
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	return as, nil
+}
+
+// addAccount writes the given account.
+func (as *snapshot) addAccount(account *Account) error {
+	a := &snapshotAccount{
+		AddressHash: fmt.Sprintf("0x%x", account.AddressHash),
+		Nonce:       account.Nonce,
+		Balance:     account.Balance.String(),
+		StorageRoot: fmt.Sprintf("0x%x", account.StorageRoot),
+		CodeHash:    fmt.Sprintf("0x%x", account.CodeHash),
+	}
+
+	if as.format == "csv" {
+		_, err := fmt.Fprintf(as.w, "%s,%d,%s,%s,%s\n",
+			a.AddressHash, a.Nonce, a.Balance, a.StorageRoot, a.CodeHash)
+		return err
+	}
+
+	return as.writeJSON(a)
+}
+
+// addSlot writes the given storage slot of an account, along with its
+// value. The slot is nil if its preimage is not known.
+func (as *snapshot) addSlot(addressHash, slotHash, slot, value []byte) error {
+	sl := &snapshotSlot{
+		AddressHash: fmt.Sprintf("0x%x", addressHash),
+		SlotHash:    fmt.Sprintf("0x%x", slotHash),
+		Value:       fmt.Sprintf("0x%x", value),
+	}
+	if slot != nil {
+		sl.Slot = fmt.Sprintf("0x%x", slot)
+	}
+
+	if as.format == "csv" {
+		_, err := fmt.Fprintf(as.w, "%s,%s,%s,%s\n",
+			sl.AddressHash, sl.SlotHash, sl.Slot, sl.Value)
+		return err
+	}
+
+	return as.writeJSON(sl)
+}
+
+// writeJSON writes the given value as a JSON line.
+func (as *snapshot) writeJSON(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = as.w.Write(append(line, '\n'))
+	return err
+}
+
+// flush writes the accounts kept in memory into the file.
+func (as *snapshot) flush() error {
+	return as.w.Flush()
+}
+
+// flushedSize flushes the snapshot, returning the size of its file.
+func (as *snapshot) flushedSize() (int64, error) {
+	err := as.flush()
+	if err != nil {
+		return 0, err
+	}
+
+	return as.file.Seek(0, io.SeekCurrent)
+}
+
+// close writes what is left in memory, and closes the file.
+func (as *snapshot) close() error {
+	err := as.flush()
+	if cerr := as.file.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
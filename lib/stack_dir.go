@@ -0,0 +1,68 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// defaultStackDir is where the traversal stacks are kept by default.
+const defaultStackDir = "/tmp/trie_stack_data_dir"
+
+// stackDirName returns the stack directory of the traversal of the given
+// range, limited to the given nibble, under the given directory. It is
+// named after all of them, so traversals of different ranges, or nibbles,
+// of the same blocks do not get in each other's way.
+func stackDirName(stackDir string, fromBlock, toBlock, step uint64, nibble string) string {
+	if stackDir == "" {
+		stackDir = defaultStackDir
+	}
+
+	name := strconv.FormatUint(fromBlock, 10)
+	if toBlock != fromBlock {
+		name += "-" + strconv.FormatUint(toBlock, 10) + "-" + strconv.FormatUint(step, 10)
+	}
+	if nibble != "" {
+		name += "-nibble-" + nibble
+	}
+
+	return filepath.Join(stackDir, name)
+}
+
+// lockStackDir makes sure no other process is using the given stack
+// directory, holding a lock on it until releaseStackDir is called.
+// As the lock is held by the operating system, it goes away
+// along with the process, even if it crashes.
+// The lock file is never removed: another process could have it open,
+// waiting to lock it, and a third one would then lock a new file of
+// the same name, both of them using the stack directory.
+func lockStackDir(dataDirectoryName string) (*os.File, error) {
+	err := os.MkdirAll(filepath.Dir(dataDirectoryName), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := os.OpenFile(dataDirectoryName+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		lock.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("stack directory %s is being used by another process", dataDirectoryName)
+		}
+		return nil, err
+	}
+
+	return lock, nil
+}
+
+// releaseStackDir releases the lock taken by lockStackDir.
+func releaseStackDir(lock *os.File) {
+	syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+	lock.Close()
+}
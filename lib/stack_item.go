@@ -0,0 +1,106 @@
+package lib
+
+import "errors"
+
+// The tries a trie node can belong to
+const (
+	stateTrie byte = iota
+	storageTrie
+)
+
+// stackItem is the element we push into the traversal stack:
+// the key of a trie node, the trie it belongs to, the nibbles leading
+// to it from its root, and the hash of the account owning it, if it
+// is a storage trie node.
+// When comparing two tries, old is the key of the node found in the
+// same path of the older trie.
+// A node embedded in its parent has no key of its own, so it keeps its
+// RLP, less than 32 bytes long, along with the key of the node holding it.
+type stackItem struct {
+	key      []byte
+	trie     byte
+	path     []byte
+	account  []byte
+	old      []byte
+	embedded []byte
+}
+
+// bytes serializes the stackItem as <trie><len(key)><key>
+// <len(account)><account><len(old)><old><len(embedded)><embedded><path>.
+// The path goes last, as it is the only part of unbounded length.
+func (si *stackItem) bytes() []byte {
+	out := make([]byte, 0, 5+len(si.key)+len(si.account)+len(si.old)+len(si.embedded)+len(si.path))
+	out = append(out, si.trie)
+	out = append(out, byte(len(si.key)))
+	out = append(out, si.key...)
+	out = append(out, byte(len(si.account)))
+	out = append(out, si.account...)
+	out = append(out, byte(len(si.old)))
+	out = append(out, si.old...)
+	out = append(out, byte(len(si.embedded)))
+	out = append(out, si.embedded...)
+	out = append(out, si.path...)
+
+	return out
+}
+
+// decodeStackItem is the inverse function of stackItem.bytes().
+func decodeStackItem(raw []byte) (*stackItem, error) {
+	var err error
+
+	if len(raw) == 0 || raw[0] > storageTrie {
+		return nil, errors.New("corrupt item in the traversal stack")
+	}
+
+	si := &stackItem{trie: raw[0]}
+	raw = raw[1:]
+	if si.key, raw, err = readStackItemField(raw); err != nil {
+		return nil, err
+	}
+	if si.account, raw, err = readStackItemField(raw); err != nil {
+		return nil, err
+	}
+	if si.old, raw, err = readStackItemField(raw); err != nil {
+		return nil, err
+	}
+	if si.embedded, raw, err = readStackItemField(raw); err != nil {
+		return nil, err
+	}
+	if len(raw) > 0 {
+		si.path = raw
+	}
+
+	return si, nil
+}
+
+// readStackItemField returns the length prefixed field at the start
+// of raw (nil if empty), and the rest of raw.
+func readStackItemField(raw []byte) ([]byte, []byte, error) {
+	if len(raw) == 0 || len(raw) < 1+int(raw[0]) {
+		return nil, nil, errors.New("corrupt item in the traversal stack")
+	}
+
+	fieldLen := int(raw[0])
+	if fieldLen == 0 {
+		return nil, raw[1:], nil
+	}
+
+	return raw[1 : 1+fieldLen], raw[1+fieldLen:], nil
+}
+
+// childPath returns a new path made of the path of this item,
+// and the given nibbles.
+func (si *stackItem) childPath(nibbles []byte) []byte {
+	out := make([]byte, 0, len(si.path)+len(nibbles))
+	out = append(out, si.path...)
+	out = append(out, nibbles...)
+
+	return out
+}
+
+// fullKey returns the key this item leads to, when the given nibbles
+// of a leaf complete its path, i.e. the hash of an account or of a
+// storage slot.
+func (si *stackItem) fullKey(leafPath []byte) []byte {
+	return nibblesToBytes(si.childPath(leafPath))
+}
@@ -0,0 +1,53 @@
+package lib
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestStackItemRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{0x11}, 32)
+	account := bytes.Repeat([]byte{0x22}, 32)
+	old := bytes.Repeat([]byte{0x33}, 32)
+	fullPath := bytes.Repeat([]byte{0xf, 0}, 32)
+	embedded := []byte{0xc4, 0x20, 0x82, 0x01, 0x02}
+
+	for _, item := range []*stackItem{
+		{key: key},
+		{key: key, path: []byte{0}},
+		{key: key, path: []byte{1, 0xa, 0xf}, old: old},
+		{key: key, trie: storageTrie, account: account},
+		{key: key, trie: storageTrie, account: account, path: fullPath[:63]},
+		{key: key, trie: storageTrie, account: account, path: []byte{2}, old: old},
+		{trie: storageTrie, account: account, path: []byte{3}},
+		{key: key, trie: storageTrie, account: account, path: fullPath[:62], embedded: embedded},
+	} {
+		got, err := decodeStackItem(item.bytes())
+		if err != nil {
+			t.Errorf("%+v: %v", item, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, item) {
+			t.Errorf("got %+v, want %+v", got, item)
+		}
+	}
+}
+
+func TestDecodeCorruptStackItem(t *testing.T) {
+	valid := (&stackItem{key: bytes.Repeat([]byte{0x11}, 32), path: []byte{1, 2}}).bytes()
+
+	for _, raw := range [][]byte{
+		nil,
+		{},
+		{2},                   // unknown trie
+		{stateTrie},           // no key
+		{stateTrie, 32, 0x11}, // truncated key
+		valid[:20],
+		valid[:34], // no account
+	} {
+		if _, err := decodeStackItem(raw); err == nil {
+			t.Errorf("%x: no error", raw)
+		}
+	}
+}
@@ -2,17 +2,17 @@ package lib
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"path/filepath"
-	"strconv"
+	"sort"
+	"sync/atomic"
 
 	goque "github.com/beeker1121/goque"
-	types "github.com/ethereum/go-ethereum/core/types"
 	crypto "github.com/ethereum/go-ethereum/crypto"
-	rlp "github.com/ethereum/go-ethereum/rlp"
 	metrics "github.com/ipfs/go-ipld-eth-import/metrics"
+	leveldb "github.com/syndtr/goleveldb/leveldb"
 )
 
 // MEthStateTrie is the cid codec for a Ethereum State Trie.
@@ -24,17 +24,151 @@ type TrieStack struct {
 	*goque.Stack
 
 	db                    *GethDB
-	dumpDir               string
-	operation             string
-	firstNibbleInt        int
+	sink                  Sink
+	paths                 *pathsIndex
+	problems              *pathsIndex
+	snapshot              *snapshot
+	visitor               Visitor
+	problemVisitor        ProblemVisitor
+	nibble                string
+	nibbleRanges          []nibbleRange
 	iterationCheapCounter int
+
+	// Whether we go through the storage tries
+	// and the EVM codes of the accounts
+	storageTries bool
+	evmCodes     bool
+
+	// Whether we only go through what changed since the previous block
+	diff bool
+
+	// The operation of the configuration, empty for a Visitor. It is
+	// only kept in the checkpoint, to resume the same operation
+	configOperation string
+
+	// Whether we are one of the shards of a TriePool,
+	// which has no live output, and shares its files
+	shard bool
+
+	// The state roots to traverse, one per block of the range
+	blockNumbers []uint64
+	stateRoots   [][]byte
+	currentBlock uint64
+
+	// Where we are in the range, kept in the checkpoint
+	// to be able to resume the traversal
+	blockIndex     int
+	rootPushed     bool
+	checkpointPath string
+	lastCheckpoint int
+	stopped        int32
+
+	// The checkpoint we resumed from, if any
+	resumed *trieStackCheckpoint
+
+	// The address hashes of the accounts asked for by the storage-slots
+	// operation, telling whether they were found in the state trie
+	accounts map[string]bool
+
+	// What this traversal added to the counters of the metrics,
+	// which are shared with the rest of the shards of a TriePool
+	counters map[string]int
+
+	// visited keeps the block number in which every node was found.
+	// It is only used when traversing more than one block.
+	visited *leveldb.DB
+
+	// The stack directory is ours until we close the TrieStack,
+	// and it is removed then, if the traversal finished.
+	dataDirectoryName string
+	lock              *os.File
+	finished          bool
+}
+
+// TrieStackConfig holds the parameters of a traversal.
+type TrieStackConfig struct {
+	// Every Step-th block from FromBlock up to ToBlock is traversed
+	FromBlock uint64
+	ToBlock   uint64
+	Step      uint64
+
+	// If set, only the given branch of the state root is traversed
+	Nibble string
+
+	// One of "evmcode", "state-trie", "storage-trie", "state-diff",
+	// "accounts", "storage-slots", "verify" or "count-all".
+	// Leave it empty to go through the tries with your own Visitor
+	Operation string
+
+	// The visitor called on every node, account, storage slot and
+	// EVM code found, instead of the one of an operation. If it is a
+	// ProblemVisitor, the traversal goes on after the broken nodes
+	Visitor Visitor
+
+	// Whether the Visitor goes through the storage tries, and
+	// the EVM codes, of the accounts. Operations set their own
+	StorageTries bool
+	EVMCodes     bool
+
+	// If set, the Visitor only goes through the nodes of every block
+	// which are not in the state of the previous block of the range,
+	// comparing their tries side by side. The first block is only
+	// the base to compare with.
+	Diff bool
+
+	// Where the trie nodes, or the EVM codes, are exported to, by the
+	// "evmcode", "state-trie", "storage-trie" and "state-diff" operations
+	// (i.e. a FileSink, an IPFSSink or a CARSink). The rest of them
+	// refuse one. A Visitor may be given the sink it writes to, to
+	// have it flushed at every checkpoint
+	Sink Sink
+
+	// The directory where the traversal stack is kept.
+	// Defaults to /tmp/trie_stack_data_dir
+	StackDir string
+
+	// If set, the stack of a previous, interrupted traversal of the same
+	// range is reopened, along with its counters. The sink must be
+	// the one of the previous traversal, resumed
+	Resume bool
+
+	// If set, the trie it belongs to and the path of every trie node
+	// exported by the "state-trie", "storage-trie" and "state-diff"
+	// operations is written into this file, being the full key for
+	// leaves. It is emptied first, unless we resume
+	PathsIndex string
+
+	// Where to write the accounts or the storage slots, as "json" or
+	// "csv" lines, for the "accounts" and "storage-slots" operations
+	Snapshot       string
+	SnapshotFormat string
+
+	// The address hashes of the accounts whose storage slots
+	// are written, for the "storage-slots" operation
+	Accounts [][]byte
+
+	// Where to write the missing, mismatched and corrupt nodes found by
+	// the "verify" operation, as the lines of a paths index starting
+	// with the problem and the block it was found in. It is emptied
+	// first, unless we resume
+	VerifyReport string
+
+	// Set for the shards of a TriePool, stopping the live output.
+	// The pool truncates the paths index and the verify report for them
+	shard bool
 }
 
 // NewTrieStack initializes the traversal stack, and finds the canonical
-// block header, returning the TrieStack wrapper for further instructions
-func NewTrieStack(db *GethDB, blockNumber uint64, dumpDir, nibble, operation string) *TrieStack {
+// block headers of the range, returning the TrieStack wrapper for further
+// instructions.
+func NewTrieStack(db *GethDB, cfg *TrieStackConfig) (*TrieStack, error) {
 	var err error
-	ts := &TrieStack{}
+	ts := &TrieStack{counters: make(map[string]int)}
+
+	fromBlock, toBlock, step := cfg.FromBlock, cfg.ToBlock, cfg.Step
+
+	// The paths of the accounts, for the storage-slots operation
+	var accountRanges []nibbleRange
 
 	// Metrics in this operation
 	metrics.NewLogger("traverse-state-trie")
@@ -46,213 +180,932 @@ func NewTrieStack(db *GethDB, blockNumber uint64, dumpDir, nibble, operation str
 	metrics.NewCounter("traverse-state-trie-branches")
 	metrics.NewCounter("traverse-state-trie-extensions")
 	metrics.NewCounter("traverse-state-trie-leaves")
+	metrics.NewCounter("traverse-state-trie-embedded-nodes")
 	metrics.NewCounter("traverse-state-smart-contracts")
+	metrics.NewCounter("traverse-state-accounts")
+	metrics.NewCounter("traverse-state-storage-slots")
+	metrics.NewCounter("traverse-state-storage-tries")
+	metrics.NewCounter("traverse-state-trie-blocks")
+	metrics.NewCounter("traverse-state-trie-skipped-nodes")
+	metrics.NewCounter("traverse-state-trie-unchanged-subtries")
 
 	// Add the reference to the database
 	ts.db = db
+	ts.shard = cfg.shard
 
-	// Hardcoded stack directory. Sue me
-	dataDirectoryName := "/tmp/trie_stack_data_dir/" + strconv.FormatUint(blockNumber, 10)
-
-	// Clearing the directory if exists, as we want to start always
-	// with a fresh stack database.
-	os.RemoveAll(dataDirectoryName)
-	ts.Stack, err = goque.OpenStack(dataDirectoryName)
-	if err != nil {
-		panic(err)
+	if step == 0 {
+		return nil, errors.New("step must be greater than zero")
 	}
-
-	// Find the block header RLP we need
-	blockHash := db.GetCanonicalHash(blockNumber)
-	headerRLP := db.GetHeaderRLP(blockHash, blockNumber)
-	header := new(types.Header)
-	if err := rlp.Decode(bytes.NewReader(headerRLP), header); err != nil {
-		panic(err)
+	if fromBlock > toBlock {
+		return nil, errors.New("the starting block number must not be greater than the final one")
 	}
 
-	// Finally, Init the traversal with the state root
-	_, err = ts.Push(header.Root[:])
-	if err != nil {
-		panic(err)
+	// Find the block headers RLP we need
+	for number := fromBlock; number <= toBlock; number += step {
+		stateRoot, err := db.GetStateRoot(number)
+		if err != nil {
+			return nil, err
+		}
+
+		ts.blockNumbers = append(ts.blockNumbers, number)
+		ts.stateRoots = append(ts.stateRoots, stateRoot)
+
+		// Avoid the overflow of number
+		if toBlock-number < step {
+			break
+		}
 	}
 
 	// Assign these variables
-	ts.dumpDir = dumpDir
+	ts.sink = cfg.Sink
+	ts.nibble = cfg.Nibble
+
+	if cfg.Operation != "" && cfg.Visitor != nil {
+		return nil, errors.New("either an operation or a visitor must be given, not both")
+	}
 
-	switch operation {
+	// What the operation writes to, besides what its visitor does
+	var usesSink, usesPaths, usesReport bool
+	var snapshotHeader string
+
+	switch cfg.Operation {
 	case "evmcode":
-		ts.operation = "evmcode"
+		ts.visitor = &evmCodeVisitor{ts: ts}
+		ts.evmCodes = true
+		usesSink = true
 	case "state-trie":
-		ts.operation = "state-trie"
+		ts.visitor = &nodesVisitor{ts: ts}
+		usesSink, usesPaths = true, true
+	case "storage-trie":
+		ts.visitor = &nodesVisitor{ts: ts, storage: true}
+		ts.storageTries = true
+		usesSink, usesPaths = true, true
+	case "state-diff":
+		ts.visitor = &nodesVisitor{ts: ts}
+		ts.diff = true
+		usesSink, usesPaths = true, true
+	case "accounts":
+		ts.visitor = &accountsVisitor{ts: ts}
+		snapshotHeader = snapshotHeaders[cfg.Operation]
+		if len(ts.stateRoots) != 1 {
+			return nil, errors.New("accounts needs a single block")
+		}
+	case "storage-slots":
+		ts.visitor = &slotsVisitor{ts: ts}
+		ts.storageTries = true
+		snapshotHeader = snapshotHeaders[cfg.Operation]
+		if len(ts.stateRoots) != 1 {
+			return nil, errors.New("storage-slots needs a single block")
+		}
+		if len(cfg.Accounts) == 0 {
+			return nil, errors.New("storage-slots needs the accounts to dump")
+		}
+		if cfg.Nibble != "" {
+			return nil, errors.New("storage-slots can not be limited by a nibble")
+		}
+		// We only go down the paths of the given accounts
+		ts.accounts = make(map[string]bool)
+		for _, account := range cfg.Accounts {
+			if len(account) != 32 {
+				return nil, fmt.Errorf("wrong account hash %x", account)
+			}
+			ts.accounts[string(account)] = false
+			path := bytesToNibbles(account)
+			accountRanges = append(accountRanges, nibbleRange{lo: path, hi: path})
+		}
+	case "verify":
+		ts.visitor = newVerifyVisitor(ts)
+		ts.storageTries = true
+		ts.evmCodes = true
+		usesReport = true
 	case "count-all":
-		ts.operation = "count-all"
+		ts.visitor = BaseVisitor{}
+		ts.storageTries = true
+	case "":
+		if cfg.Visitor == nil {
+			return nil, errors.New("an operation or a visitor must be given")
+		}
+		ts.visitor = cfg.Visitor
+		ts.storageTries = cfg.StorageTries
+		ts.evmCodes = cfg.EVMCodes
+		ts.diff = cfg.Diff
+		usesSink = cfg.Sink != nil
 	default:
-		panic("operation not supported")
+		return nil, errors.New("operation not supported")
+	}
+	ts.problemVisitor, _ = ts.visitor.(ProblemVisitor)
+	ts.configOperation = cfg.Operation
+
+	// The operations exporting nodes need somewhere to put them,
+	// and nothing we are given is left unused
+	if usesSink && ts.sink == nil {
+		return nil, fmt.Errorf("%s needs a sink", cfg.Operation)
+	}
+	name := cfg.Operation
+	if name == "" {
+		name = "a visitor"
+	}
+	if !usesSink && ts.sink != nil {
+		return nil, fmt.Errorf("%s does not export to a sink", name)
+	}
+	if !usesPaths && cfg.PathsIndex != "" {
+		return nil, fmt.Errorf("%s does not write a paths index", name)
+	}
+	if !usesReport && cfg.VerifyReport != "" {
+		return nil, fmt.Errorf("%s does not write a verify report", name)
+	}
+	if snapshotHeader == "" && cfg.Snapshot != "" {
+		return nil, fmt.Errorf("%s does not write a snapshot", name)
+	}
+	if ts.diff && len(ts.stateRoots) < 2 {
+		return nil, errors.New("a diff needs a range of at least two blocks")
 	}
 
-	if len(nibble) > 1 {
-		panic("unsupported nibble lenght")
+	// The stack directory is named after the range and the nibble.
+	// We make sure nobody else is using it before touching anything.
+	dataDirectoryName := stackDirName(cfg.StackDir, fromBlock, toBlock, step, cfg.Nibble)
+	ts.dataDirectoryName = dataDirectoryName
+	ts.checkpointPath = dataDirectoryName + ".checkpoint"
+	ts.lock, err = lockStackDir(dataDirectoryName)
+	if err != nil {
+		return nil, err
+	}
+
+	// From here on, the stack directory is released on failure
+	err = ts.openStack(cfg.Resume)
+	// The paths index and the verify report go back to the checkpoint.
+	// The pool truncates them for its shards.
+	var pathsSize, problemsSize int64
+	if ts.resumed != nil {
+		pathsSize, problemsSize = ts.resumed.PathsSize, ts.resumed.ProblemsSize
+	}
+	if ts.shard {
+		pathsSize, problemsSize = -1, -1
 	}
-	if len(nibble) == 1 {
-		n := nibble[0]
-		switch {
-		case n >= '0' && n <= '9':
-			ts.firstNibbleInt = int(n - 48)
-		case n >= 'a' && n <= 'f':
-			ts.firstNibbleInt = int(n + 10 - 97)
-		default:
-			panic("wrong value for nibble")
+	if err == nil && cfg.PathsIndex != "" {
+		ts.paths, err = openPathsIndex(cfg.PathsIndex, pathsSize)
+	}
+	if err == nil && cfg.VerifyReport != "" {
+		ts.problems, err = openPathsIndex(cfg.VerifyReport, problemsSize)
+	}
+	if snapshotHeader != "" && err == nil {
+		var size int64
+		if ts.resumed != nil {
+			size = ts.resumed.SnapshotSize
 		}
-	} else {
-		ts.firstNibbleInt = -1
+		ts.snapshot, err = openSnapshot(cfg.Snapshot, cfg.SnapshotFormat, snapshotHeader, cfg.Resume, size)
+	}
+	if accountRanges != nil {
+		ts.nibbleRanges = accountRanges
+	}
+	if err != nil {
+		ts.Close()
+		return nil, err
 	}
 
 	// Return the wrapped object
-	ts.iterationCheapCounter = 0
-	return ts
+	return ts, nil
+}
+
+// openStack opens the traversal stack in the stack directory,
+// restoring the checkpoint of the previous traversal if we resume it.
+func (ts *TrieStack) openStack(resume bool) error {
+	var err error
+
+	// Unless we resume a previous traversal, clearing the directory
+	// if exists, as we want to start with a fresh stack database.
+	// When resuming, the stack goes back to the one of the checkpoint,
+	// as what was done after it may not have reached the sink.
+	var cp *trieStackCheckpoint
+	if resume {
+		cp, err = loadCheckpoint(ts.checkpointPath)
+		if err != nil {
+			return err
+		}
+		err = ts.restoreCheckpoint(cp)
+		if err != nil {
+			return err
+		}
+		os.RemoveAll(ts.dataDirectoryName)
+		fmt.Printf("Resuming the traversal at iteration %d\n", ts.iterationCheapCounter)
+	} else {
+		os.RemoveAll(ts.dataDirectoryName)
+		os.RemoveAll(ts.dataDirectoryName + "-visited")
+		os.Remove(ts.checkpointPath)
+	}
+	ts.Stack, err = goque.OpenStack(ts.dataDirectoryName)
+	if err != nil {
+		return err
+	}
+	if cp != nil {
+		for _, value := range cp.Stack {
+			if _, err = ts.Push(value); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Nodes shared between the state roots of the range are only
+	// traversed the first time we find them. A diff already prunes
+	// them, comparing the tries side by side.
+	if len(ts.stateRoots) > 1 && !ts.diff {
+		ts.visited, err = leveldb.OpenFile(ts.dataDirectoryName+"-visited", nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	// If set, only the paths of the state trie in these ranges are traversed
+	ts.nibbleRanges, err = parseNibbleRanges(ts.nibble)
+	if err != nil {
+		return err
+	}
+	if ts.nibbleRanges != nil && !ts.shard {
+		fmt.Printf("Reduced traversing from the root, down to %s\n", ts.nibble)
+	}
+
+	return nil
 }
 
 // TraverseStateTrie performs a stack assisted traversal
-// over the state trie node.
-func (ts *TrieStack) TraverseStateTrie() {
+// over the state trie nodes of every block of the range.
+// A checkpoint is saved regularly, and when Stop() is called,
+// so the traversal can be resumed.
+// It stops at the first node which can not be processed, which is
+// kept in the stack, so the traversal can be resumed from it as well.
+func (ts *TrieStack) TraverseStateTrie() error {
 	_l := metrics.StartLogDiff("traverse-state-trie")
+	defer metrics.StopLogDiff("traverse-state-trie", _l)
 
-	for {
-		ts.liveCounter()
-		err := ts.traverseStateTrieIteration()
-		if err == goque.ErrEmpty {
-			break
+	for idx := ts.blockIndex; idx < len(ts.stateRoots); idx++ {
+		ts.currentBlock = ts.blockNumbers[idx]
+		if len(ts.stateRoots) > 1 && !ts.shard {
+			fmt.Printf("Traversing the state trie of block %d\n", ts.currentBlock)
 		}
-		if err != nil {
-			panic(err)
+
+		// Init the traversal with the state root, unless we are
+		// resuming the traversal of this block.
+		if !ts.rootPushed {
+			if ts.ownsPath(stateTrie, nil) {
+				ts.incCounter("traverse-state-trie-blocks")
+			}
+			if err := ts.pushStateRoot(idx); err != nil {
+				return err
+			}
+			ts.blockIndex, ts.rootPushed = idx, true
+			if err := ts.saveCheckpoint(); err != nil {
+				return err
+			}
+		}
+
+		for {
+			if ts.Interrupted() {
+				return ts.saveCheckpoint()
+			}
+
+			err := ts.traverseStateTrieIteration()
+			if err == goque.ErrEmpty {
+				break
+			}
+			if err != nil {
+				// Keep what we have done so far, to be resumed
+				ts.saveCheckpoint()
+				return err
+			}
+
+			if ts.iterationCheapCounter-ts.lastCheckpoint >= checkpointInterval {
+				if err := ts.saveCheckpoint(); err != nil {
+					return err
+				}
+			}
+		}
+
+		ts.blockIndex, ts.rootPushed = idx+1, false
+		if err := ts.saveCheckpoint(); err != nil {
+			return err
+		}
+	}
+
+	// Nothing left to resume, the stack directory
+	// will be removed on Close()
+	ts.finished = true
+
+	return nil
+}
+
+// pushStateRoot inits the traversal of the block at the given
+// index of the range with its state root.
+func (ts *TrieStack) pushStateRoot(idx int) error {
+	stateRoot := ts.stateRoots[idx]
+
+	// When diffing, the first block of the range is only the base
+	// to compare with, and an unchanged state root has nothing new.
+	if ts.diff {
+		if idx == 0 || bytes.Equal(stateRoot, ts.stateRoots[idx-1]) {
+			return nil
+		}
+		return ts.pushItem(&stackItem{key: stateRoot, old: ts.stateRoots[idx-1]})
+	}
+
+	return ts.pushItem(&stackItem{key: stateRoot})
+}
+
+// Stop makes the traversal return after the current iteration,
+// saving a checkpoint to resume it. It is safe to call it from
+// another goroutine (i.e. a signal handler).
+func (ts *TrieStack) Stop() {
+	atomic.StoreInt32(&ts.stopped, 1)
+}
+
+// Interrupted tells whether Stop() was called.
+func (ts *TrieStack) Interrupted() bool {
+	return atomic.LoadInt32(&ts.stopped) == 1
+}
+
+// MissingAccounts returns the address hashes of the accounts asked for by
+// the storage-slots operation which are not in the state trie, sorted.
+// It is only complete once the traversal finished.
+func (ts *TrieStack) MissingAccounts() [][]byte {
+	return ts.filterAccounts(false)
+}
+
+// foundAccounts returns the address hashes of the accounts asked
+// for by the storage-slots operation found so far, sorted.
+func (ts *TrieStack) foundAccounts() [][]byte {
+	return ts.filterAccounts(true)
+}
+
+func (ts *TrieStack) filterAccounts(found bool) [][]byte {
+	var out [][]byte
+	for account, ok := range ts.accounts {
+		if ok == found {
+			out = append(out, []byte(account))
 		}
 	}
+	sort.Slice(out, func(i, j int) bool { return bytes.Compare(out[i], out[j]) < 0 })
 
-	metrics.StopLogDiff("traverse-state-trie", _l)
+	return out
+}
+
+// Close closes the traversal stack, and the index of visited nodes,
+// if any. If the traversal finished, they are removed from the
+// stack directory, along with the checkpoint.
+func (ts *TrieStack) Close() {
+	if ts.Stack != nil {
+		ts.Stack.Close()
+	}
+	if ts.paths != nil {
+		ts.paths.close()
+	}
+	if ts.problems != nil {
+		ts.problems.close()
+	}
+	if ts.snapshot != nil {
+		ts.snapshot.close()
+	}
+	if ts.visited != nil {
+		ts.visited.Close()
+	}
+
+	if ts.finished {
+		os.RemoveAll(ts.dataDirectoryName)
+		os.RemoveAll(ts.dataDirectoryName + "-visited")
+		os.Remove(ts.checkpointPath)
+	}
+	releaseStackDir(ts.lock)
 }
 
 // traverseStateTrieIteration is the atomic component of the
 // loop in TraverseStateTrie.
 func (ts *TrieStack) traverseStateTrieIteration() error {
+	// Get the next item from the stack.
+	// We only peek it, as it must stay in the stack until its children
+	// are pushed, so an interruption does not make us lose any of them.
+	rawItem, err := ts.Peek()
+	if err != nil {
+		return err
+	}
+
+	// An empty item is a node whose children were already pushed
+	if len(rawItem.Value) == 0 {
+		_, err = ts.Pop()
+		return err
+	}
+	ts.liveCounter()
+
 	_l := metrics.StartLogDiff("traverse-state-trie-iterations")
+	defer metrics.StopLogDiff("traverse-state-trie-iterations", _l)
+	stackLength := ts.Length()
 
-	// Get the next item from the stack
-	item, err := ts.Pop()
+	item, err := decodeStackItem(rawItem.Value)
 	if err != nil {
 		return err
 	}
 	// This clarifies a bit the code below
-	key := item.Value
+	key := item.key
 
-	// Fetch the value
-	val := ts.fetchFromGethDB(key)
-
-	switch ts.operation {
-	case "evmcode":
-		// If it is a leaf, we will get its EVM Code
-		evmCodeKey := getTrieNodeEVMCode(val)
-		if evmCodeKey != nil {
-			code := ts.fetchFromGethDB(evmCodeKey)
-			ts.storeFile(crypto.Keccak256(code), code)
+	// An embedded node is part of the RLP of the node holding it,
+	// whose key it keeps, so there is nothing to fetch
+	val := item.embedded
+	if val != nil {
+		if ts.ownsPath(item.trie, item.path) {
+			ts.incCounter("traverse-state-trie-embedded-nodes")
 		}
-	case "state-trie":
-		// Just store the found element
-		ts.storeFile(key, val)
-	case "count-all":
-		// Add storage trie to the traversal
-		storageRoot := getTrieNodeStorageRoot(val)
-		if storageRoot != nil {
-			_, err := ts.Push(storageRoot)
+	} else {
+		// A node found in a previous block of the range was already
+		// processed, along with all its subtree
+		visited, err := ts.wasVisited(key)
+		if err != nil {
+			return err
+		}
+		if visited {
+			if ts.ownsPath(item.trie, item.path) {
+				ts.incCounter("traverse-state-trie-skipped-nodes")
+			}
+			return ts.doneWithItem(rawItem.ID, stackLength)
+		}
+
+		// Fetch the value
+		val, err = ts.fetchFromGethDB(key)
+
+		// A ProblemVisitor is told about a missing or mismatched node,
+		// and the traversal goes on, leaving out what is under it
+		if ts.problemVisitor != nil {
+			problem, err := checkValue(key, val, err)
 			if err != nil {
-				panic(err)
+				return err
+			}
+			if problem != "" {
+				if problem == "missing" {
+					val = nil
+				}
+				err = ts.onMissingNode(item, val)
+				if err != nil {
+					return err
+				}
+				return ts.doneWithItem(rawItem.ID, stackLength)
 			}
 		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err = ts.processNode(item, val)
+	if ts.problemVisitor != nil && isCorruptNodeError(err) {
+		err = ts.onCorruptNode(item, val, err)
+		if err != nil {
+			return err
+		}
+		return ts.doneWithItem(rawItem.ID, stackLength)
+	}
+	if err != nil {
+		return withKey(err, key)
+	}
+
+	// Only the nodes we got through are skipped in the blocks that
+	// follow, so the problems are found again in every block having them
+	if item.embedded == nil {
+		err = ts.markVisited(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return ts.doneWithItem(rawItem.ID, stackLength)
+}
+
+// processNode goes through the given trie node with the visitor of the
+// traversal, pushing its children to the stack.
+func (ts *TrieStack) processNode(item *stackItem, val []byte) error {
+	decoded, err := DecodeTrieNode(val)
+	if err != nil {
+		return err
+	}
+
+	// The nibbles of the key of a leaf, nil for the rest of nodes
+	leaf, isLeaf := decoded.(*Leaf)
+	var leafPath []byte
+	if isLeaf {
+		leafPath = leaf.Path
+	}
+
+	// If --nibble is set, a leaf of the state trie found above the
+	// paths we want could be out of them. We only want the ones in.
+	if item.trie == stateTrie && isLeaf &&
+		!matchesNibbleRanges(ts.nibbleRanges, item.childPath(leafPath)) {
+		return nil
+	}
+
+	// Embedded nodes are given to the visitor without a key
+	var key []byte
+	if item.embedded == nil {
+		key = item.key
+	}
+	node := &TrieNode{
+		Key:      key,
+		RLP:      val,
+		Decoded:  decoded,
+		Account:  item.account,
+		Path:     item.childPath(leafPath),
+		item:     item,
+		leafPath: leafPath,
+	}
+
+	// The shards of a TriePool go through the nodes above their paths,
+	// but only one of them visits and counts every one of those
+	if !ts.ownsPath(item.trie, node.Path) {
+		return ts.findChildrenToStack(item, decoded)
+	}
+
+	switch decoded.(type) {
+	case *Branch:
+		ts.incCounter("traverse-state-trie-branches")
+		err = ts.visitor.OnBranch(node)
+	case *Extension:
+		ts.incCounter("traverse-state-trie-extensions")
+		err = ts.visitor.OnExtension(node)
+	case *Leaf:
+		ts.incCounter("traverse-state-trie-leaves")
+		err = ts.visitLeaf(node, leaf)
+	}
+	if err != nil {
+		return err
 	}
 
 	// Find the children of this element.
 	// If found, they will be pushed in the stack.
-	ts.findChildrenToStack(val)
+	return ts.findChildrenToStack(item, decoded)
+}
 
-	metrics.StopLogDiff("traverse-state-trie-iterations", _l)
-	return nil
+// visitLeaf goes through the given leaf with the visitor, and then,
+// through the account or the storage slot it holds. The storage trie
+// and the EVM code of an account follow, if we go through them.
+func (ts *TrieStack) visitLeaf(node *TrieNode, leaf *Leaf) error {
+	err := ts.visitor.OnLeaf(node)
+	if err != nil {
+		return err
+	}
+
+	// The full key of the leaf
+	fullKey := node.item.fullKey(node.leafPath)
+
+	if node.item.trie == storageTrie {
+		value, err := leaf.SlotValue()
+		if err != nil {
+			return err
+		}
+
+		ts.incCounter("traverse-state-storage-slots")
+		return ts.visitor.OnStorageSlot(&StorageSlot{
+			AddressHash: node.Account,
+			SlotHash:    fullKey,
+			Value:       value,
+		})
+	}
+
+	account, err := leaf.Account(fullKey)
+	if err != nil {
+		return err
+	}
+
+	ts.incCounter("traverse-state-accounts")
+	err = ts.visitor.OnAccount(account)
+	if err != nil {
+		return err
+	}
+
+	if ts.storageTries {
+		err = ts.pushStorageRoot(account)
+		if err != nil {
+			return err
+		}
+	}
+
+	if bytes.Equal(account.CodeHash, emptyCodeHash) {
+		return nil
+	}
+	ts.incCounter("traverse-state-smart-contracts")
+	if !ts.evmCodes {
+		return nil
+	}
+
+	return ts.visitCode(node, account)
+}
+
+// pushStorageRoot pushes the storage trie of the given account,
+// if any, tagging it with the account hash.
+func (ts *TrieStack) pushStorageRoot(account *Account) error {
+	if bytes.Equal(account.StorageRoot, emptyRoot[:]) {
+		return nil
+	}
+
+	ts.incCounter("traverse-state-storage-tries")
+	return ts.pushItem(&stackItem{
+		key:     account.StorageRoot,
+		trie:    storageTrie,
+		account: account.AddressHash,
+	})
+}
+
+// visitCode fetches the EVM code of the account in the given leaf, going
+// through it with the visitor. A ProblemVisitor is told about a missing
+// or mismatched code instead.
+func (ts *TrieStack) visitCode(node *TrieNode, account *Account) error {
+	code, err := ts.fetchFromGethDB(account.CodeHash)
+
+	if ts.problemVisitor != nil {
+		problem, err := checkValue(account.CodeHash, code, err)
+		if err != nil {
+			return err
+		}
+		if problem != "" {
+			if problem == "missing" {
+				code = nil
+			}
+			return ts.problemVisitor.OnMissingCode(node, account, code)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return ts.visitor.OnCode(&Code{
+		AddressHash: account.AddressHash,
+		CodeHash:    account.CodeHash,
+		Code:        code,
+	})
+}
+
+// onMissingNode tells the ProblemVisitor about the given missing node,
+// or the value found under its key, if mismatched. Like the nodes
+// themselves, the problems above the paths of the shards of a TriePool
+// are found by one of them.
+func (ts *TrieStack) onMissingNode(item *stackItem, val []byte) error {
+	if !ts.ownsPath(item.trie, item.path) {
+		return nil
+	}
+
+	return ts.problemVisitor.OnMissingNode(&TrieNode{
+		Key:     item.key,
+		RLP:     val,
+		Account: item.account,
+		Path:    item.path,
+		item:    item,
+	})
+}
+
+// onCorruptNode tells the ProblemVisitor about the given node, whose
+// value we could not decode, or the account or storage slot in it.
+func (ts *TrieStack) onCorruptNode(item *stackItem, val []byte, err error) error {
+	if !ts.ownsPath(item.trie, item.path) {
+		return nil
+	}
+
+	// Embedded nodes are given without a key
+	var key []byte
+	if item.embedded == nil {
+		key = item.key
+	}
+	return ts.problemVisitor.OnCorruptNode(&TrieNode{
+		Key:     key,
+		RLP:     val,
+		Account: item.account,
+		Path:    item.path,
+		item:    item,
+	}, err)
+}
+
+// checkValue tells whether the value fetched for the given key is
+// "missing", or "mismatched", when its keccak256 hash is not the key.
+// Any other error fetching it is returned.
+func checkValue(key, val []byte, err error) (string, error) {
+	if _, missing := err.(*KeyNotFoundError); missing {
+		return "missing", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(crypto.Keccak256(val), key) {
+		return "mismatched", nil
+	}
+
+	return "", nil
+}
+
+// isCorruptNodeError tells whether the given error comes
+// from a trie node we are not able to decode.
+func isCorruptNodeError(err error) bool {
+	switch err.(type) {
+	case *CorruptRLPError, *UnknownNodeTypeError:
+		return true
+	}
+
+	return false
+}
+
+// ownsPath tells whether the node at the given path of the given trie is
+// ours to visit. The shards of a TriePool all go through the nodes of the
+// state trie above their own paths, and only the first shard under
+// every one of those nodes visits it.
+func (ts *TrieStack) ownsPath(trie byte, path []byte) bool {
+	if !ts.shard || trie != stateTrie {
+		return true
+	}
+
+	shardPath := ts.nibbleRanges[0].lo
+	if len(path) >= len(shardPath) {
+		return true
+	}
+	for _, n := range shardPath[len(path):] {
+		if n != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// recordPath writes down the path of the given exported node
+// into the paths index, if any.
+func (ts *TrieStack) recordPath(item *stackItem, leafPath []byte) error {
+	if ts.paths == nil {
+		return nil
+	}
+
+	return ts.paths.add(item, leafPath)
+}
+
+// incCounter increments the given counter of the metrics,
+// keeping what we add to it to be saved in the checkpoint.
+func (ts *TrieStack) incCounter(key string) {
+	ts.counters[key]++
+	metrics.IncCounter(key)
 }
 
 // liveCounter gives the lonely user some company
 func (ts *TrieStack) liveCounter() {
 	ts.iterationCheapCounter++
-	fmt.Printf("%d\r", ts.iterationCheapCounter)
+	if !ts.shard {
+		fmt.Printf("%d\r", ts.iterationCheapCounter)
+	}
 }
 
 // fetchFromGethDB returns the value from the cold LevelDB.
-func (ts *TrieStack) fetchFromGethDB(key []byte) []byte {
+// If it is missing, a KeyNotFoundError is returned.
+func (ts *TrieStack) fetchFromGethDB(key []byte) ([]byte, error) {
 	_l := metrics.StartLogDiff("geth-leveldb-get-queries")
 
 	val, err := ts.db.Get(key)
 	if err != nil {
-		panic(err)
+		metrics.StopLogDiff("geth-leveldb-get-queries", _l)
+		return nil, err
 	}
 	metrics.AddLog("new-nodes-bytes-tranferred", int64(len(val)))
 
 	metrics.StopLogDiff("geth-leveldb-get-queries", _l)
-	return val
+	return val, nil
 }
 
-// findChildrenToStack evaluates a trie node. If it finds any
+// findChildrenToStack evaluates a decoded trie node. If it finds any
 // children, it will add them to the stack, to follow the traversal.
-func (ts *TrieStack) findChildrenToStack(rawVal []byte) {
+func (ts *TrieStack) findChildrenToStack(item *stackItem, node DecodedTrieNode) error {
+	var err error
+
 	_l := metrics.StartLogDiff("trie-node-children-processes")
+	defer metrics.StopLogDiff("trie-node-children-processes", _l)
 
-	// TODO
-	// Fix the parsing of branches on getTrieNodeChildren().
-	// This catch-all can do meanwhile.
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Println("Recovered in findChildrenToStack ", r)
-		}
-	}()
-
-	children := getTrieNodeChildren(rawVal)
-	if children != nil {
-		for idx, child := range children {
-			// If we are in the first iteration (i.e. the root),
-			// we see whether --nibble is set. If so, process only the given one.
-			if ts.iterationCheapCounter == 1 && ts.firstNibbleInt != -1 {
-				if idx != ts.firstNibbleInt {
-					continue
-				}
-				// Tell the user what's going on
-				fmt.Printf("Reduced traversing from the root, down to %d\n",
-					ts.firstNibbleInt)
-			}
+	children := trieNodeChildren(node)
 
-			_, err := ts.Push(child)
-			if err != nil {
-				panic(err)
+	// When diffing, we pair every child with the one found
+	// in the same path of the older node
+	var oldChildren map[string][]byte
+	if item.old != nil {
+		oldChildren, err = ts.findOldChildren(item.old)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The children are pushed in reverse order, so they are popped in the
+	// order of their paths, and the leaves are found sorted by their keys.
+	// The embedded ones are pushed as well, to keep that order.
+	for idx := len(children) - 1; idx >= 0; idx-- {
+		child := children[idx]
+		childPath := item.childPath(child.Path)
+
+		// If --nibble is set, in the state trie we only follow
+		// the branches and extensions leading to its paths.
+		if item.trie == stateTrie && !matchesNibbleRanges(ts.nibbleRanges, childPath) {
+			continue
+		}
+
+		// Equal hashes mean equal subtries, nothing new down there
+		old := oldChildren[string(child.Path)]
+		if old != nil && (bytes.Equal(old, child.Key) || bytes.Equal(old, child.Embedded)) {
+			if ts.ownsPath(item.trie, childPath) {
+				ts.incCounter("traverse-state-trie-unchanged-subtries")
 			}
+			continue
+		}
+
+		// An embedded node has no key to compare with
+		if len(old) != 32 {
+			old = nil
+		}
+
+		// Embedded nodes are part of the RLP of this one, whose key
+		// they keep, and so is their subtrie, as it is smaller
+		childItem := &stackItem{
+			key:     child.Key,
+			trie:    item.trie,
+			path:    childPath,
+			account: item.account,
+			old:     old,
+		}
+		if child.Embedded != nil {
+			childItem.key = item.key
+			childItem.old = nil
+			childItem.embedded = child.Embedded
+		}
+		err = ts.pushItem(childItem)
+		if err != nil {
+			return err
 		}
 	}
 
-	metrics.StopLogDiff("trie-node-children-processes", _l)
+	return nil
 }
 
-// storeFile will take the trie node contents, and store them into
-// the file system, with the given key as a file name.
-// It will take the first three bytes as subdirectories,
-// to make its lookup easier.
-func (ts *TrieStack) storeFile(key, contents []byte) {
-	_l := metrics.StartLogDiff("file-creations")
+// findOldChildren fetches the given node of the older trie, returning
+// its children keyed by the nibbles leading to them.
+func (ts *TrieStack) findOldChildren(oldKey []byte) (map[string][]byte, error) {
+	out := make(map[string][]byte)
 
-	fileName := fmt.Sprintf("%x", key)
-	fileDir := filepath.Join(ts.dumpDir, fileName[0:2], fileName[2:4], fileName[4:6])
-	err := os.MkdirAll(fileDir, 0755)
+	val, err := ts.fetchFromGethDB(oldKey)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-
-	err = ioutil.WriteFile(filepath.Join(fileDir, fileName), contents, 0644)
+	node, err := DecodeTrieNode(val)
 	if err != nil {
-		panic(err)
+		return nil, withKey(err, oldKey)
+	}
+	for _, child := range trieNodeChildren(node) {
+		if child.Embedded != nil {
+			out[string(child.Path)] = child.Embedded
+			continue
+		}
+		out[string(child.Path)] = child.Key
 	}
 
-	metrics.StopLogDiff("file-creations", _l)
+	return out, nil
+}
+
+// wasVisited tells whether the given node was found in a previous
+// block of the range. A node marked in a later block was found after
+// the checkpoint we resumed from, so it is found again.
+func (ts *TrieStack) wasVisited(key []byte) (bool, error) {
+	if ts.visited == nil {
+		return false, nil
+	}
+
+	val, err := ts.visited.Get(key, nil)
+	if err != nil && err != leveldb.ErrNotFound {
+		return false, err
+	}
+
+	return val != nil && binary.BigEndian.Uint64(val) < ts.currentBlock, nil
+}
+
+// markVisited marks the given node as found in the current block,
+// once it was fetched, checked and processed.
+func (ts *TrieStack) markVisited(key []byte) error {
+	if ts.visited == nil {
+		return nil
+	}
+
+	encodedNumber := make([]byte, 8)
+	binary.BigEndian.PutUint64(encodedNumber, ts.currentBlock)
+	return ts.visited.Put(key, encodedNumber, nil)
+}
+
+// doneWithItem takes the processed item out of the stack. If nothing
+// was pushed on top of it, it is popped, otherwise it is emptied,
+// to be popped once the traversal goes back to it.
+func (ts *TrieStack) doneWithItem(id, stackLength uint64) error {
+	var err error
+
+	if ts.Length() == stackLength {
+		_, err = ts.Pop()
+	} else {
+		_, err = ts.Update(id, []byte{})
+	}
+
+	return err
+}
+
+// pushItem adds the given item to the traversal stack.
+func (ts *TrieStack) pushItem(item *stackItem) error {
+	_, err := ts.Push(item.bytes())
+	return err
 }
@@ -1,13 +1,12 @@
 package lib
 
 import (
-	"bytes"
 	"fmt"
+	"math/big"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/rlp"
-	"github.com/ipfs/go-ipld-eth-import/metrics"
 )
 
 var emptyCodeHash = crypto.Keccak256(nil)
@@ -15,188 +14,260 @@ var emptyCodeHash = crypto.Keccak256(nil)
 // This is the known root hash of an empty trie.
 var emptyRoot = common.HexToHash("56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421")
 
-// getTrieNodeChildren will decode the given RLP.
-// If the result is a branch or extension, it will return its
-// children hashes, otherwise, nil will be returned.
-func getTrieNodeChildren(rlpTrieNode []byte) [][]byte {
-	var (
-		out [][]byte
-		i   []interface{}
-	)
+// DecodedTrieNode is a trie node decoded from its RLP,
+// being a *Branch, an *Extension or a *Leaf.
+type DecodedTrieNode interface {
+	// Kind is "branch", "extension" or "leaf"
+	Kind() string
+}
 
-	// Decode the node
-	err := rlp.DecodeBytes(rlpTrieNode, &i)
-	if err != nil {
-		// Zero tolerance, if we have an err here,
-		// it means our source database could be in bad shape.
-		panic(err)
-	}
+// Branch is a branch node, with a child for every nibble
+// continuing the paths going through it.
+type Branch struct {
+	// The children, in the order of their nibbles.
+	// The path of every child is its nibble
+	Children []TrieNodeChild
 
-	switch len(i) {
-	case 2:
-		first := i[0].([]byte)
-		last := i[1].([]byte)
+	// The value of the 17th element, empty in Ethereum,
+	// as every key of a trie has the same length
+	Value []byte
+}
 
-		switch first[0] / 16 {
-		case '\x00':
-			fallthrough
-		case '\x01':
-			// This is an extension
-			metrics.IncCounter("traverse-state-trie-extensions")
-			out = [][]byte{last}
-		case '\x02':
-			fallthrough
-		case '\x03':
-			// This is a leaf
-			metrics.IncCounter("traverse-state-trie-leaves")
-			out = nil
-		default:
-			// Zero tolerance
-			panic("unknown hex prefix on trie node")
-		}
+// Extension is an extension node, shortening
+// the path shared by all the keys under it.
+type Extension struct {
+	// The nibbles of the shared path
+	Path []byte
 
-	case 17:
-		// This is a branch
-		metrics.IncCounter("traverse-state-trie-branches")
-
-		for _, vi := range i {
-			v := vi.([]byte)
-			switch len(v) {
-			case 0:
-				continue
-			case 32:
-				out = append(out, v)
-			default:
-				panic(fmt.Sprintf("unrecognized object: %v", v))
-			}
+	// The only child, whose path is the shared one
+	Child TrieNodeChild
+}
+
+// Leaf is a leaf node, holding the value of a key.
+type Leaf struct {
+	// The nibbles left of the key, from the path leading to the leaf
+	Path []byte
+
+	// The RLP of an account in the state trie,
+	// or of the value of a storage slot in a storage trie
+	Value []byte
+}
+
+// TrieNodeChild is the reference to a child of a branch or extension,
+// along with the nibbles leading to it from its parent.
+// Children whose RLP is shorter than 32 bytes are not referenced by
+// their hash, but embedded in their parent. In that case, Key is nil
+// and Embedded has their RLP.
+type TrieNodeChild struct {
+	Key      []byte
+	Path     []byte
+	Embedded []byte
+}
+
+// Kind returns "branch".
+func (b *Branch) Kind() string { return "branch" }
+
+// Kind returns "extension".
+func (e *Extension) Kind() string { return "extension" }
+
+// Kind returns "leaf".
+func (l *Leaf) Kind() string { return "leaf" }
+
+// Child returns the child of the given nibble, or nil if there is none.
+func (b *Branch) Child(nibble byte) *TrieNodeChild {
+	for idx := range b.Children {
+		if b.Children[idx].Path[0] == nibble {
+			return &b.Children[idx]
 		}
+	}
 
-	default:
-		panic("unknown trie node type")
+	return nil
+}
+
+// Account decodes the value of a leaf of the state trie,
+// being the account of the given address hash.
+func (l *Leaf) Account(addressHash []byte) (*Account, error) {
+	// The account is [nonce, balance, storage root, code hash]
+	var elements [][]byte
+	err := rlp.DecodeBytes(l.Value, &elements)
+	if err != nil {
+		return nil, &CorruptRLPError{Err: err}
+	}
+	if len(elements) != 4 {
+		return nil, &CorruptRLPError{Err: fmt.Errorf("account with %d elements", len(elements))}
 	}
 
-	return out
+	return &Account{
+		AddressHash: addressHash,
+		Nonce:       new(big.Int).SetBytes(elements[0]).Uint64(),
+		Balance:     new(big.Int).SetBytes(elements[1]),
+		StorageRoot: elements[2],
+		CodeHash:    elements[3],
+	}, nil
+}
+
+// SlotValue decodes the value of a leaf of a storage trie,
+// being the value of a storage slot.
+func (l *Leaf) SlotValue() ([]byte, error) {
+	var value []byte
+	err := rlp.DecodeBytes(l.Value, &value)
+	if err != nil {
+		return nil, &CorruptRLPError{Err: err}
+	}
+
+	return value, nil
 }
 
-// getTrieNodeEVMCode will decode the given RLP.
-// If the result is a leaf, it will return its EVM Code.
-// If the codehash is equal to the empty value, it will return nil.
-func getTrieNodeEVMCode(rlpTrieNode []byte) []byte {
-	var (
-		out []byte
-		i   []interface{}
-	)
+// DecodeTrieNode decodes the given RLP of a trie node, returning
+// a *Branch, an *Extension or a *Leaf, with their paths as nibbles.
+func DecodeTrieNode(rlpTrieNode []byte) (DecodedTrieNode, error) {
+	var i []interface{}
 
 	// Decode the node
 	err := rlp.DecodeBytes(rlpTrieNode, &i)
 	if err != nil {
-		panic(err)
+		// If we have an err here,
+		// it means our source database could be in bad shape.
+		return nil, &CorruptRLPError{Err: err}
 	}
 
 	switch len(i) {
 	case 2:
-		first := i[0].([]byte)
-		last := i[1].([]byte)
+		first, ok := i[0].([]byte)
+		if !ok || len(first) == 0 {
+			return nil, &UnknownNodeTypeError{Reason: "wrong hex prefix encoded path"}
+		}
+		path := decodeCompactPath(first)
 
 		switch first[0] / 16 {
 		case '\x00':
 			fallthrough
 		case '\x01':
-			// This is an extension
-			out = nil
+			// The child of an extension may be embedded
+			child, err := getTrieNodeChild(i[1], path)
+			if err != nil {
+				return nil, err
+			}
+			if child == nil {
+				return nil, &UnknownNodeTypeError{Reason: "extension without child"}
+			}
+			return &Extension{Path: path, Child: *child}, nil
 		case '\x02':
 			fallthrough
 		case '\x03':
-			// This is a leaf
-			var account []interface{}
-			err = rlp.DecodeBytes(last, &account)
-			if err != nil {
-				panic(err)
+			value, ok := i[1].([]byte)
+			if !ok {
+				return nil, &UnknownNodeTypeError{Reason: fmt.Sprintf("unrecognized object: %v", i[1])}
 			}
+			return &Leaf{Path: path, Value: value}, nil
+		default:
+			return nil, &UnknownNodeTypeError{Reason: "unknown hex prefix on trie node"}
+		}
 
-			codeHash := account[3].([]byte)
-			if !bytes.Equal(codeHash, emptyCodeHash) {
-				metrics.IncCounter("traverse-state-smart-contracts")
-				out = codeHash
-			} else {
-				out = nil
+	case 17:
+		branch := &Branch{}
+
+		// The 17th element is the value, not a child
+		for idx, vi := range i[:16] {
+			child, err := getTrieNodeChild(vi, []byte{byte(idx)})
+			if err != nil {
+				return nil, err
 			}
+			if child != nil {
+				branch.Children = append(branch.Children, *child)
+			}
+		}
 
-		default:
-			// Zero tolerance
-			panic("unknown hex prefix on trie node")
+		value, ok := i[16].([]byte)
+		if !ok {
+			return nil, &UnknownNodeTypeError{Reason: fmt.Sprintf("unrecognized object: %v", i[16])}
 		}
+		branch.Value = value
 
-	case 17:
-		// This is a branch
-		out = nil
+		return branch, nil
 
 	default:
-		panic("unknown trie node type")
+		return nil, &UnknownNodeTypeError{Reason: fmt.Sprintf("%d elements in the node", len(i))}
 	}
-
-	return out
 }
 
-// getTrieNodeStorageRoot will decode the given RLP.
-// If the result is a leaf, it will return its Storage Trie.
-// If the Storage Trie is equal to the empty trie, it will return nil.
-func getTrieNodeStorageRoot(rlpTrieNode []byte) []byte {
-	var (
-		out []byte
-		i   []interface{}
-	)
+// trieNodeChildren returns the children of the given node,
+// being none for a leaf.
+func trieNodeChildren(node DecodedTrieNode) []TrieNodeChild {
+	switch n := node.(type) {
+	case *Branch:
+		return n.Children
+	case *Extension:
+		return []TrieNodeChild{n.Child}
+	}
 
-	// Decode the node
-	err := rlp.DecodeBytes(rlpTrieNode, &i)
-	if err != nil {
-		panic(err)
+	return nil
+}
+
+// getTrieNodeChild returns the child referenced by the given element of
+// a branch or extension, which is either its hash, or the child itself,
+// embedded, if its RLP is shorter than 32 bytes. An empty element
+// means there is no child, returning nil.
+func getTrieNodeChild(element interface{}, path []byte) (*TrieNodeChild, error) {
+	switch v := element.(type) {
+	case []byte:
+		switch len(v) {
+		case 0:
+			return nil, nil
+		case 32:
+			return &TrieNodeChild{Key: v, Path: path}, nil
+		default:
+			return nil, &UnknownNodeTypeError{Reason: fmt.Sprintf("unrecognized object: %v", v)}
+		}
+	case []interface{}:
+		// Encoding it back gives us the RLP it had
+		// inside of its parent, as it is canonical
+		embedded, err := rlp.EncodeToBytes(v)
+		if err != nil {
+			return nil, &CorruptRLPError{Err: err}
+		}
+		if len(embedded) >= 32 {
+			return nil, &UnknownNodeTypeError{Reason: "embedded trie node of 32 bytes or more"}
+		}
+		return &TrieNodeChild{Path: path, Embedded: embedded}, nil
+	default:
+		return nil, &UnknownNodeTypeError{Reason: fmt.Sprintf("unrecognized object: %v", v)}
 	}
+}
 
-	switch len(i) {
-	case 2:
-		first := i[0].([]byte)
-		last := i[1].([]byte)
+// decodeCompactPath returns the nibbles of a hex prefix encoded path.
+// The flag nibble tells us whether the path has an odd length,
+// in which case its second nibble is the first one of the path.
+func decodeCompactPath(compact []byte) []byte {
+	out := make([]byte, 0, 2*len(compact))
 
-		switch first[0] / 16 {
-		case '\x00':
-			fallthrough
-		case '\x01':
-			// This is an extension
-			out = nil
-		case '\x02':
-			fallthrough
-		case '\x03':
-			// This is a leaf
-			var account []interface{}
-			err = rlp.DecodeBytes(last, &account)
-			if err != nil {
-				// Ignore the error, as we are probably dealing
-				// with a storage trie leaf
-				// TODO
-				// Improve the stack we are using so we can know this
-				// And procede better
-				return nil
-			}
+	if (compact[0]/16)&1 == 1 {
+		out = append(out, compact[0]%16)
+	}
+	for _, b := range compact[1:] {
+		out = append(out, b/16, b%16)
+	}
 
-			storageRoot := account[2].([]byte)
-			if !bytes.Equal(storageRoot, emptyRoot[:]) {
-				out = storageRoot
-			} else {
-				out = nil
-			}
+	return out
+}
 
-		default:
-			// Zero tolerance
-			panic("unknown hex prefix on trie node")
-		}
+// nibblesToBytes packs a path of nibbles into bytes,
+// i.e. the 64 nibbles of a full path into a 32 bytes key.
+func nibblesToBytes(nibbles []byte) []byte {
+	out := make([]byte, len(nibbles)/2)
+	for idx := range out {
+		out[idx] = nibbles[2*idx]<<4 | nibbles[2*idx+1]
+	}
 
-	case 17:
-		// This is a branch
-		out = nil
+	return out
+}
 
-	default:
-		panic("unknown trie node type")
+// bytesToNibbles unpacks the given bytes into nibbles,
+// i.e. a 32 bytes key into the 64 nibbles of its full path.
+func bytesToNibbles(b []byte) []byte {
+	out := make([]byte, 0, 2*len(b))
+	for _, v := range b {
+		out = append(out, v/16, v%16)
 	}
 
 	return out
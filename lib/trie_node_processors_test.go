@@ -0,0 +1,207 @@
+package lib
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	common "github.com/ethereum/go-ethereum/common"
+	rlp "github.com/ethereum/go-ethereum/rlp"
+	trie "github.com/ethereum/go-ethereum/trie"
+)
+
+func TestDecodeCompactPath(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		compact []byte
+		want    []byte
+	}{
+		{"empty extension", []byte{0x00}, []byte{}},
+		{"even extension", []byte{0x00, 0x12, 0x34}, []byte{1, 2, 3, 4}},
+		{"odd extension", []byte{0x11, 0x23}, []byte{1, 2, 3}},
+		{"empty leaf", []byte{0x20}, []byte{}},
+		{"even leaf", []byte{0x20, 0xab}, []byte{0xa, 0xb}},
+		{"single nibble leaf", []byte{0x3f}, []byte{0xf}},
+		{"odd leaf", []byte{0x31, 0x23, 0x45}, []byte{1, 2, 3, 4, 5}},
+	} {
+		got := decodeCompactPath(tc.compact)
+		if !bytes.Equal(got, tc.want) || got == nil {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// mustRLP encodes the given value, as an element of a trie node.
+func mustRLP(t *testing.T, val interface{}) []byte {
+	out, err := rlp.EncodeToBytes(val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestDecodeTrieNode(t *testing.T) {
+	hash := bytes.Repeat([]byte{0xab}, 32)
+	embeddedLeaf := []interface{}{[]byte{0x3f}, []byte("v")}
+	embeddedRLP := mustRLP(t, embeddedLeaf)
+
+	branch := make([]interface{}, 17)
+	for idx := range branch {
+		branch[idx] = []byte{}
+	}
+	branch[3] = hash
+	branch[0xa] = embeddedLeaf
+
+	for _, tc := range []struct {
+		name string
+		node interface{}
+		want DecodedTrieNode
+	}{
+		{
+			"even leaf",
+			[]interface{}{[]byte{0x20, 0xab}, []byte("value")},
+			&Leaf{Path: []byte{0xa, 0xb}, Value: []byte("value")},
+		},
+		{
+			"odd leaf",
+			[]interface{}{[]byte{0x31, 0x23}, []byte("value")},
+			&Leaf{Path: []byte{1, 2, 3}, Value: []byte("value")},
+		},
+		{
+			"even extension",
+			[]interface{}{[]byte{0x00, 0x12}, hash},
+			&Extension{Path: []byte{1, 2}, Child: TrieNodeChild{Key: hash, Path: []byte{1, 2}}},
+		},
+		{
+			"odd extension with an embedded child",
+			[]interface{}{[]byte{0x11}, embeddedLeaf},
+			&Extension{Path: []byte{1}, Child: TrieNodeChild{Path: []byte{1}, Embedded: embeddedRLP}},
+		},
+		{
+			"branch with a hashed and an embedded child",
+			branch,
+			&Branch{
+				Children: []TrieNodeChild{
+					{Key: hash, Path: []byte{3}},
+					{Path: []byte{0xa}, Embedded: embeddedRLP},
+				},
+				Value: []byte{},
+			},
+		},
+	} {
+		got, err := DecodeTrieNode(mustRLP(t, tc.node))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDecodeTrieNodeErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		rlp     []byte
+		corrupt bool
+	}{
+		{"not a list", mustRLP(t, []byte("node")), true},
+		{"truncated", mustRLP(t, []interface{}{[]byte{0x20}, []byte("value")})[:4], true},
+		{"three elements", mustRLP(t, []interface{}{[]byte{0x20}, []byte{}, []byte{}}), false},
+		{"unknown flag", mustRLP(t, []interface{}{[]byte{0x40}, []byte("value")}), false},
+		{"empty path", mustRLP(t, []interface{}{[]byte{}, []byte("value")}), false},
+		{"extension without child", mustRLP(t, []interface{}{[]byte{0x00, 0x12}, []byte{}}), false},
+		{"short hash", mustRLP(t, []interface{}{[]byte{0x00, 0x12}, []byte{1, 2, 3}}), false},
+	} {
+		_, err := DecodeTrieNode(tc.rlp)
+		switch err.(type) {
+		case *CorruptRLPError:
+			if !tc.corrupt {
+				t.Errorf("%s: got %v, want an UnknownNodeTypeError", tc.name, err)
+			}
+		case *UnknownNodeTypeError:
+			if tc.corrupt {
+				t.Errorf("%s: got %v, want a CorruptRLPError", tc.name, err)
+			}
+		default:
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+	}
+}
+
+// memoryWriter keeps the nodes committed by go-ethereum.
+type memoryWriter map[string][]byte
+
+func (w memoryWriter) Put(key, value []byte) error {
+	w[string(key)] = common.CopyBytes(value)
+	return nil
+}
+
+// collectValues decodes the given node, and the ones under it, fetched
+// from the given nodes or embedded, keeping the values by their keys.
+// It returns the number of embedded nodes found.
+func collectValues(t *testing.T, nodes memoryWriter, val, path []byte, out map[string]string) int {
+	node, err := DecodeTrieNode(val)
+	if err != nil {
+		t.Fatalf("%x: %v", path, err)
+	}
+
+	switch n := node.(type) {
+	case *Leaf:
+		out[string(nibblesToBytes(append(path, n.Path...)))] = string(n.Value)
+		return 0
+	case *Branch:
+		if len(n.Value) > 0 {
+			out[string(nibblesToBytes(path))] = string(n.Value)
+		}
+	}
+
+	var embedded int
+	for _, child := range trieNodeChildren(node) {
+		childPath := append(append([]byte{}, path...), child.Path...)
+		childVal := child.Embedded
+		if childVal != nil {
+			embedded++
+		} else {
+			childVal = nodes[string(child.Key)]
+			if childVal == nil {
+				t.Fatalf("%x: missing child %x", path, child.Key)
+			}
+		}
+		embedded += collectValues(t, nodes, childVal, childPath, out)
+	}
+
+	return embedded
+}
+
+func TestDecodeTrieNodeOfGethTrie(t *testing.T) {
+	// Short keys and values give embedded nodes, and a branch with a value
+	want := map[string]string{
+		"do":    "verb",
+		"dog":   "puppy",
+		"doge":  "coin",
+		"horse": "stallion",
+		"h":     "x",
+		"hors":  "y",
+	}
+
+	tr, _ := trie.New(common.Hash{}, nil)
+	for key, value := range want {
+		tr.Update([]byte(key), []byte(value))
+	}
+	nodes := make(memoryWriter)
+	root, err := tr.CommitTo(nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]string)
+	embedded := collectValues(t, nodes, nodes[string(root[:])], []byte{}, got)
+	if embedded == 0 {
+		t.Fatal("the trie has no embedded nodes")
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,598 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	common "github.com/ethereum/go-ethereum/common"
+	types "github.com/ethereum/go-ethereum/core/types"
+	crypto "github.com/ethereum/go-ethereum/crypto"
+	rlp "github.com/ethereum/go-ethereum/rlp"
+	trie "github.com/ethereum/go-ethereum/trie"
+)
+
+func TestVerifyReportAfterRepair(t *testing.T) {
+	db, cleanDB := newFixtureDB(t, 400)
+	defer cleanDB()
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	// Take out the first child of the state root
+	stateRoot, err := db.GetStateRoot(fixtureBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := db.Get(stateRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := DecodeTrieNode(val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	child := trieNodeChildren(root)[0]
+	childVal, err := db.Get(child.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.db.Delete(child.Key, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := fixtureConfig(dir, "verify")
+	cfg.VerifyReport = filepath.Join(dir, "report.txt")
+	traverse(t, db, cfg)
+	report, err := ioutil.ReadFile(cfg.VerifyReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(report), "missing-node ") || strings.Count(string(report), "\n") != 1 {
+		t.Fatalf("unexpected report %q", report)
+	}
+
+	// Once repaired, the report is empty
+	if err = db.db.Put(child.Key, childVal, nil); err != nil {
+		t.Fatal(err)
+	}
+	traverse(t, db, cfg)
+	report, err = ioutil.ReadFile(cfg.VerifyReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 0 {
+		t.Fatalf("the repaired trie is reported with %q", report)
+	}
+}
+
+func TestStackDirOfNibbles(t *testing.T) {
+	db, cleanDB := newFixtureDB(t, 50)
+	defer cleanDB()
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	// Traversals of different nibbles of the same block run side by side
+	var stacks []*TrieStack
+	for _, nibble := range []string{"0-7", "8-f"} {
+		cfg := fixtureConfig(dir, "count-all")
+		cfg.Nibble = nibble
+		ts, err := NewTrieStack(db, cfg)
+		if err != nil {
+			t.Fatalf("nibble %s: %v", nibble, err)
+		}
+		stacks = append(stacks, ts)
+	}
+	defer func() {
+		for _, ts := range stacks {
+			ts.Close()
+		}
+	}()
+
+	// But not two of the same
+	cfg := fixtureConfig(dir, "count-all")
+	cfg.Nibble = "8-f"
+	if ts, err := NewTrieStack(db, cfg); err == nil {
+		ts.Close()
+		t.Fatal("the stack directory of a running traversal is opened again")
+	}
+}
+
+// recordVisitor keeps the nodes and the storage slots it is given.
+type recordVisitor struct {
+	BaseVisitor
+	hashed   map[string][]byte
+	embedded int
+	slots    []*StorageSlot
+}
+
+func (rv *recordVisitor) OnBranch(node *TrieNode) error    { return rv.record(node) }
+func (rv *recordVisitor) OnExtension(node *TrieNode) error { return rv.record(node) }
+func (rv *recordVisitor) OnLeaf(node *TrieNode) error      { return rv.record(node) }
+
+func (rv *recordVisitor) record(node *TrieNode) error {
+	if node.Account == nil {
+		return nil
+	}
+	if node.Key == nil {
+		rv.embedded++
+		return nil
+	}
+	rv.hashed[string(node.Key)] = node.Path
+	return nil
+}
+
+func (rv *recordVisitor) OnStorageSlot(slot *StorageSlot) error {
+	rv.slots = append(rv.slots, slot)
+	return nil
+}
+
+func TestTraverseEmbeddedNodes(t *testing.T) {
+	// Keys sharing all but their last nibbles leave their leaves deep in
+	// the trie, with short paths, so short values make them embedded,
+	// along with the branches holding them. A long value is not.
+	prefix := make([]byte, 30)
+	want := map[string]string{
+		string(append(prefix, 0x00, 0x01)): "a",
+		string(append(prefix, 0x00, 0x02)): "b",
+		string(append(prefix, 0x00, 0x13)): "c",
+		string(append(prefix, 0x01, 0x00)): "d",
+		string(append(prefix, 0x02, 0x00)): "e",
+		string(append(prefix, 0x03, 0x00)): string(bytes.Repeat([]byte("f"), 40)),
+	}
+	storage, _ := trie.New(common.Hash{}, nil)
+	for key, value := range want {
+		encoded, _ := rlp.EncodeToBytes([]byte(value))
+		storage.Update([]byte(key), encoded)
+	}
+	nodes := make(memoryWriter)
+	storageRoot, err := storage.CommitTo(nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	embedded := collectValues(t, nodes, nodes[string(storageRoot[:])], []byte{}, make(map[string]string))
+	if embedded == 0 {
+		t.Fatal("the storage trie has no embedded nodes")
+	}
+
+	addressHash := crypto.Keccak256(fixtureAddress(0))
+	db, cleanDB := newCustomFixtureDB(t, func(w fixtureWriter, state *trie.Trie) {
+		for key, value := range nodes {
+			w.Put([]byte(key), value)
+		}
+		state.Update(addressHash, fixtureAccount(1, storageRoot, common.BytesToHash(emptyCodeHash)))
+	})
+	defer cleanDB()
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	// Every node is visited once, the embedded ones without a key
+	rv := &recordVisitor{hashed: make(map[string][]byte)}
+	cfg := fixtureConfig(dir, "")
+	cfg.Visitor = rv
+	cfg.StorageTries = true
+	traverse(t, db, cfg)
+	if len(rv.hashed) != len(nodes) || rv.embedded != embedded {
+		t.Errorf("visited %d hashed and %d embedded nodes, want %d and %d",
+			len(rv.hashed), rv.embedded, len(nodes), embedded)
+	}
+
+	// The storage slots are found sorted by their keys
+	var keys []string
+	for key := range want {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var gotKeys []string
+	for _, slot := range rv.slots {
+		gotKeys = append(gotKeys, string(slot.SlotHash))
+		if !bytes.Equal(slot.AddressHash, addressHash) || string(slot.Value) != want[string(slot.SlotHash)] {
+			t.Errorf("slot %x: got the value %q of the account %x", slot.SlotHash, slot.Value, slot.AddressHash)
+		}
+	}
+	if !reflect.DeepEqual(gotKeys, keys) {
+		t.Errorf("got the slots %x, want %x", gotKeys, keys)
+	}
+
+	// The paths index has the hashed nodes alone, with their paths
+	cfg = fixtureConfig(dir, "storage-trie")
+	cfg.Sink = NewCountSink()
+	cfg.PathsIndex = filepath.Join(dir, "paths")
+	traverse(t, db, cfg)
+	index, err := ioutil.ReadFile(cfg.PathsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(index), "\n"), "\n")
+	if len(lines) != len(nodes) {
+		t.Fatalf("the paths index has %d lines, want %d", len(lines), len(nodes))
+	}
+	for _, line := range lines {
+		fields := strings.Split(line, " ")
+		if len(fields) != 4 {
+			t.Fatalf("unexpected line %q", line)
+		}
+		path, ok := rv.hashed[string(common.FromHex(fields[0]))]
+		var wantPath string
+		for _, n := range path {
+			wantPath += fmt.Sprintf("%x", n)
+		}
+		if !ok || fields[1] != "storage" || fields[2] != common.Bytes2Hex(addressHash) || fields[3] != wantPath {
+			t.Errorf("unexpected line %q", line)
+		}
+	}
+}
+
+func TestVerifyReportOfEveryBlock(t *testing.T) {
+	// Two blocks whose state tries share all but one of
+	// the children of their roots
+	var stateRoot2 common.Hash
+	db, cleanDB := newCustomFixtureDB(t, func(w fixtureWriter, state *trie.Trie) {
+		state2, _ := trie.New(common.Hash{}, nil)
+		for idx := 0; idx < 400; idx++ {
+			account := fixtureAccount(uint64(idx), emptyRoot, common.BytesToHash(emptyCodeHash))
+			state.Update(crypto.Keccak256(fixtureAddress(idx)), account)
+			state2.Update(crypto.Keccak256(fixtureAddress(idx)), account)
+		}
+		state2.Update(crypto.Keccak256(fixtureAddress(400)), fixtureAccount(400, emptyRoot, common.BytesToHash(emptyCodeHash)))
+		var err error
+		if stateRoot2, err = state2.CommitTo(w); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer cleanDB()
+	writeFixtureHeader(t, fixtureWriter{db: db.db}, fixtureBlock+1, &types.Header{Root: stateRoot2})
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	// Take out a child shared by both roots
+	stateRoot, err := db.GetStateRoot(fixtureBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	children := func(key []byte) map[string]bool {
+		val, err := db.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node, err := DecodeTrieNode(val)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := make(map[string]bool)
+		for _, child := range trieNodeChildren(node) {
+			out[string(child.Key)] = true
+		}
+		return out
+	}
+	children2 := children(stateRoot2[:])
+	var shared []byte
+	for key := range children(stateRoot) {
+		if children2[key] {
+			shared = []byte(key)
+			break
+		}
+	}
+	if err = db.db.Delete(shared, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// It is reported in both blocks
+	cfg := fixtureConfig(dir, "verify")
+	cfg.ToBlock = fixtureBlock + 1
+	cfg.VerifyReport = filepath.Join(dir, "report.txt")
+	traverse(t, db, cfg)
+	report, err := ioutil.ReadFile(cfg.VerifyReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(report), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected report %q", report)
+	}
+	for idx, line := range lines {
+		prefix := fmt.Sprintf("missing-node %d %x state - ", fixtureBlock+idx, shared)
+		if !strings.HasPrefix(line, prefix) {
+			t.Errorf("got the line %q, want it starting with %q", line, prefix)
+		}
+	}
+}
+
+// problemRecorder keeps the problems it is told about.
+type problemRecorder struct {
+	BaseVisitor
+	missing [][]byte
+	corrupt []*TrieNode
+	codes   [][]byte
+}
+
+func (pr *problemRecorder) OnMissingNode(node *TrieNode) error {
+	pr.missing = append(pr.missing, node.Key)
+	return nil
+}
+
+func (pr *problemRecorder) OnCorruptNode(node *TrieNode, err error) error {
+	pr.corrupt = append(pr.corrupt, node)
+	return nil
+}
+
+func (pr *problemRecorder) OnMissingCode(node *TrieNode, account *Account, code []byte) error {
+	pr.codes = append(pr.codes, account.AddressHash)
+	return nil
+}
+
+func TestProblemVisitor(t *testing.T) {
+	// A leaf whose value is not an account, and a contract without its code
+	corruptHash := crypto.Keccak256(fixtureAddress(0))
+	contractHash := crypto.Keccak256(fixtureAddress(1))
+	db, cleanDB := newCustomFixtureDB(t, func(w fixtureWriter, state *trie.Trie) {
+		state.Update(corruptHash, bytes.Repeat([]byte{0x01}, 40))
+		state.Update(contractHash, fixtureAccount(1, emptyRoot, crypto.Keccak256Hash([]byte{0x60})))
+		for idx := 2; idx < 200; idx++ {
+			state.Update(crypto.Keccak256(fixtureAddress(idx)), fixtureAccount(uint64(idx), emptyRoot, common.BytesToHash(emptyCodeHash)))
+		}
+	})
+	defer cleanDB()
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	// And a child of the state root above neither of them
+	stateRoot, err := db.GetStateRoot(fixtureBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := db.Get(stateRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := DecodeTrieNode(val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var missing []byte
+	for _, child := range trieNodeChildren(root) {
+		if child.Path[0] != corruptHash[0]>>4 && child.Path[0] != contractHash[0]>>4 {
+			missing = child.Key
+			break
+		}
+	}
+	if err = db.db.Delete(missing, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The traversal goes on after every problem
+	pr := &problemRecorder{}
+	cfg := fixtureConfig(dir, "")
+	cfg.Visitor = pr
+	cfg.EVMCodes = true
+	traverse(t, db, cfg)
+
+	if len(pr.missing) != 1 || !bytes.Equal(pr.missing[0], missing) {
+		t.Errorf("got the missing nodes %x, want %x", pr.missing, missing)
+	}
+	if len(pr.codes) != 1 || !bytes.Equal(pr.codes[0], contractHash) {
+		t.Errorf("got the missing codes of %x, want %x", pr.codes, contractHash)
+	}
+	if len(pr.corrupt) != 1 || !bytes.Contains(pr.corrupt[0].RLP, bytes.Repeat([]byte{0x01}, 40)) ||
+		!bytes.Equal(crypto.Keccak256(pr.corrupt[0].RLP), pr.corrupt[0].Key) {
+		t.Errorf("got the corrupt nodes %+v, want the leaf of %x", pr.corrupt, corruptHash)
+	}
+}
+
+func TestUnusedOutputs(t *testing.T) {
+	db, cleanDB := newFixtureDB(t, 50)
+	defer cleanDB()
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	for _, tc := range []struct {
+		operation string
+		set       func(cfg *TrieStackConfig)
+	}{
+		{"accounts", func(cfg *TrieStackConfig) { cfg.Sink = NewCountSink() }},
+		{"verify", func(cfg *TrieStackConfig) { cfg.Sink = NewCountSink() }},
+		{"count-all", func(cfg *TrieStackConfig) { cfg.Sink = NewCountSink() }},
+		{"evmcode", func(cfg *TrieStackConfig) {
+			cfg.Sink = NewCountSink()
+			cfg.PathsIndex = filepath.Join(dir, "paths")
+		}},
+		{"state-trie", func(cfg *TrieStackConfig) {
+			cfg.Sink = NewCountSink()
+			cfg.VerifyReport = filepath.Join(dir, "report")
+		}},
+		{"verify", func(cfg *TrieStackConfig) { cfg.Snapshot = filepath.Join(dir, "snapshot") }},
+		{"", func(cfg *TrieStackConfig) {
+			cfg.Visitor = BaseVisitor{}
+			cfg.PathsIndex = filepath.Join(dir, "paths")
+		}},
+	} {
+		cfg := fixtureConfig(dir, tc.operation)
+		tc.set(cfg)
+		ts, err := NewTrieStack(db, cfg)
+		if err == nil {
+			ts.Close()
+			t.Errorf("%q: an unused output is taken", tc.operation)
+		}
+	}
+
+	// A visitor may have its sink flushed at the checkpoints
+	cfg := fixtureConfig(dir, "")
+	cfg.Visitor = BaseVisitor{}
+	cfg.Sink = NewCountSink()
+	traverse(t, db, cfg)
+}
+
+func TestStorageSlots(t *testing.T) {
+	db, cleanDB := newFixtureDB(t, 400)
+	defer cleanDB()
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	defer func(interval int) { checkpointInterval = interval }(checkpointInterval)
+	checkpointInterval = 2
+
+	// The contracts 0, 3 and 6 have 1, 4 and 7 slots, the account 1 has
+	// none, and the last one is not in the state trie
+	var accounts [][]byte
+	for _, idx := range []int{0, 3, 6, 1, 1000} {
+		accounts = append(accounts, crypto.Keccak256(fixtureAddress(idx)))
+	}
+	missing := accounts[4]
+
+	// Only the first slot has its preimage
+	slot := common.LeftPadBytes([]byte{0}, 32)
+	slotHash := crypto.Keccak256(slot)
+	if err := db.db.Put(append([]byte("secure-key-"), slotHash...), slot, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	slotsConfig := func(name string) *TrieStackConfig {
+		cfg := fixtureConfig(filepath.Join(dir, name), "storage-slots")
+		cfg.Snapshot = filepath.Join(dir, name+".csv")
+		cfg.SnapshotFormat = "csv"
+		cfg.Accounts = accounts
+		return cfg
+	}
+
+	// The accounts found before crashing are kept in the checkpoint
+	for _, crash := range []int{0, 10} {
+		cfg := slotsConfig(fmt.Sprintf("crash-%d", crash))
+		if crash > 0 {
+			crashTraversal(t, db, cfg, crash)
+			cfg.Resume = true
+		}
+
+		ts, err := NewTrieStack(db, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ts.TraverseStateTrie(); err != nil {
+			t.Fatal(err)
+		}
+		got := ts.MissingAccounts()
+		ts.Close()
+		if len(got) != 1 || !bytes.Equal(got[0], missing) {
+			t.Fatalf("crashing after %d nodes, got missing accounts %x, want %x", crash, got, missing)
+		}
+
+		data, err := ioutil.ReadFile(cfg.Snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		if lines[0] != snapshotHeaders["storage-slots"] {
+			t.Fatalf("got header %q", lines[0])
+		}
+		slots := make(map[string]int)
+		for _, line := range lines[1:] {
+			fields := strings.Split(line, ",")
+			slots[fields[0]]++
+			preimage := fields[1] == fmt.Sprintf("0x%x", slotHash)
+			if preimage != (fields[2] == fmt.Sprintf("0x%x", slot)) || !preimage && fields[2] != "" {
+				t.Fatalf("got the slot %q of %s", fields[2], fields[1])
+			}
+		}
+		want := map[string]int{
+			fmt.Sprintf("0x%x", accounts[0]): 1,
+			fmt.Sprintf("0x%x", accounts[1]): 4,
+			fmt.Sprintf("0x%x", accounts[2]): 7,
+		}
+		if !reflect.DeepEqual(slots, want) {
+			t.Fatalf("crashing after %d nodes, got the slots %v, want %v", crash, slots, want)
+		}
+	}
+}
+
+// memorySink counts how many times every value is put into it.
+type memorySink struct {
+	CountSink
+	puts map[string]int
+}
+
+func (ms *memorySink) Put(key, account, value []byte, format string) error {
+	if !bytes.Equal(key, crypto.Keccak256(value)) {
+		return fmt.Errorf("the value of %x is not its preimage", key)
+	}
+	ms.puts[string(key)]++
+	return nil
+}
+
+func TestStateDiff(t *testing.T) {
+	// The nonces of the accounts of every block: the second one changes
+	// a few accounts and adds another one, the third one is the same,
+	// and the fourth one changes a few more
+	nonces := make([]map[int]uint64, 5)
+	nonces[1] = make(map[int]uint64)
+	for idx := 0; idx < 400; idx++ {
+		nonces[1][idx] = uint64(idx)
+	}
+	for number := 2; number <= 4; number++ {
+		nonces[number] = make(map[int]uint64)
+		for idx, nonce := range nonces[number-1] {
+			nonces[number][idx] = nonce
+		}
+	}
+	for idx := 0; idx < 5; idx++ {
+		nonces[2][idx] += 1000
+		nonces[4][200+idx] += 1000
+	}
+	nonces[2][400] = 400
+	nonces[3][400] = 400
+	nonces[4][400] = 400
+
+	// Every node committed for every block
+	fillState := func(tr *trie.Trie, number int) {
+		for idx, nonce := range nonces[number] {
+			tr.Update(crypto.Keccak256(fixtureAddress(idx)), fixtureAccount(nonce, emptyRoot, common.BytesToHash(emptyCodeHash)))
+		}
+	}
+	committed := make([]memoryWriter, 5)
+	db, cleanDB := newCustomFixtureDB(t, func(w fixtureWriter, state *trie.Trie) {
+		fillState(state, 1)
+		for number := 1; number <= 4; number++ {
+			tr, _ := trie.New(common.Hash{}, nil)
+			fillState(tr, number)
+			committed[number] = make(memoryWriter)
+			root, err := tr.CommitTo(committed[number])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if number > 1 {
+				for key, val := range committed[number] {
+					w.Put([]byte(key), val)
+				}
+				writeFixtureHeader(t, w, uint64(number), &types.Header{Root: root})
+			}
+		}
+	})
+	defer cleanDB()
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	// Only the nodes not in the trie of the previous block are put
+	want := make(map[string]int)
+	for number := 2; number <= 4; number++ {
+		for key := range committed[number] {
+			if _, ok := committed[number-1][key]; !ok {
+				want[key]++
+			}
+		}
+	}
+	if len(want) == 0 || len(want) >= len(committed[4]) {
+		t.Fatalf("the blocks share nothing, or have nothing new: %d new nodes", len(want))
+	}
+
+	sink := &memorySink{puts: make(map[string]int)}
+	cfg := fixtureConfig(dir, "state-diff")
+	cfg.ToBlock = 4
+	cfg.Sink = sink
+	traverse(t, db, cfg)
+
+	if !reflect.DeepEqual(sink.puts, want) {
+		t.Fatalf("got %d new nodes, want %d", len(sink.puts), len(want))
+	}
+}
@@ -0,0 +1,301 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	metrics "github.com/ipfs/go-ipld-eth-import/metrics"
+)
+
+// Traverser is what the importers need from a TrieStack or a TriePool.
+type Traverser interface {
+	TraverseStateTrie() error
+	Stop()
+	Interrupted() bool
+	Close()
+}
+
+// Static checks
+var _ Traverser = (*TrieStack)(nil)
+var _ Traverser = (*TriePool)(nil)
+
+// TriePool traverses the state trie with several workers at the same time.
+// The trie is sharded by the first nibbles of the path, every shard being
+// traversed by a TrieStack of its own, all of them sharing the database
+// handle and the metrics. Every shard goes through the nodes above its
+// path prefix, but each of them is only visited by the first shard under it,
+// so a pool visits and counts the same nodes as a single TrieStack.
+type TriePool struct {
+	db      *GethDB
+	cfg     TrieStackConfig
+	workers int
+	shards  []string
+
+	dataDirectoryName string
+	shardsDir         string
+	lock              *os.File
+	finished          int32
+	stopped           int32
+
+	// The TrieStacks being traversed at the moment
+	mutex   sync.Mutex
+	running map[string]*TrieStack
+}
+
+// NewTriePool returns a TriePool for the given configuration,
+// which will be traversed by the given number of workers.
+// The trie is split by the path prefixes of shardNibbles (1 or 2) nibbles.
+// The Nibble of the configuration is ignored, as we use it for sharding.
+func NewTriePool(db *GethDB, cfg *TrieStackConfig, workers, shardNibbles int) (*TriePool, error) {
+	var err error
+
+	if workers < 1 {
+		return nil, errors.New("the number of workers must be greater than zero")
+	}
+	if shardNibbles < 1 || shardNibbles > 2 {
+		return nil, errors.New("the number of shard nibbles must be 1 or 2")
+	}
+
+	// The shards share the sink and append to the same paths index,
+	// but a snapshot, starting with a header, can not be shared
+	if _, ok := snapshotHeaders[cfg.Operation]; ok {
+		return nil, fmt.Errorf("%s can not be traversed by a pool of workers", cfg.Operation)
+	}
+
+	metrics.NewLogger("traverse-state-trie-pool")
+
+	tp := &TriePool{
+		db:      db,
+		cfg:     *cfg,
+		workers: workers,
+		running: make(map[string]*TrieStack),
+	}
+
+	// One shard per path prefix of the given length
+	numShards := 1 << uint(4*shardNibbles)
+	for n := 0; n < numShards; n++ {
+		tp.shards = append(tp.shards, fmt.Sprintf("%0*x", shardNibbles, n))
+	}
+
+	// The stacks of the shards go in their own subdirectories.
+	// We lock the stack directory a TrieStack would use for this range,
+	// so nobody else traverses it at the same time.
+	dataDirectoryName := stackDirName(cfg.StackDir, cfg.FromBlock, cfg.ToBlock, cfg.Step, "")
+	tp.dataDirectoryName = dataDirectoryName
+	tp.shardsDir = dataDirectoryName + "-shards"
+	tp.lock, err = lockStackDir(dataDirectoryName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unless we resume, we start fresh
+	if !cfg.Resume {
+		os.RemoveAll(tp.shardsDir)
+	}
+
+	// The shards append to the same paths index and verify report, so we
+	// truncate them for them: to zero, or to the largest size they had
+	// at their checkpoints. What a shard wrote after its own checkpoint,
+	// and before that size, is written again, and so it is repeated.
+	var pathsSize, problemsSize int64
+	if cfg.Resume {
+		checkpoints, err := tp.shardCheckpoints()
+		if err != nil {
+			releaseStackDir(tp.lock)
+			return nil, err
+		}
+		for _, cp := range checkpoints {
+			if cp.PathsSize > pathsSize {
+				pathsSize = cp.PathsSize
+			}
+			if cp.ProblemsSize > problemsSize {
+				problemsSize = cp.ProblemsSize
+			}
+		}
+	}
+	if cfg.PathsIndex != "" {
+		err = truncatePathsIndex(cfg.PathsIndex, pathsSize)
+	}
+	if err == nil && cfg.VerifyReport != "" {
+		err = truncatePathsIndex(cfg.VerifyReport, problemsSize)
+	}
+	if err != nil {
+		releaseStackDir(tp.lock)
+		return nil, err
+	}
+
+	return tp, nil
+}
+
+// shardFiles returns the stack directory of the given shard, its
+// checkpoint, and the marker left once it is finished.
+func (tp *TriePool) shardFiles(shard string) (string, string, string) {
+	shardDir := filepath.Join(tp.shardsDir, shard)
+	checkpointPath := stackDirName(shardDir, tp.cfg.FromBlock, tp.cfg.ToBlock, tp.cfg.Step, shard) + ".checkpoint"
+
+	return shardDir, checkpointPath, shardDir + ".done"
+}
+
+// shardCheckpoints returns the checkpoints of the shards traversed so
+// far. The finished ones keep their last checkpoint as their marker.
+func (tp *TriePool) shardCheckpoints() ([]*trieStackCheckpoint, error) {
+	var out []*trieStackCheckpoint
+	for _, shard := range tp.shards {
+		_, checkpointPath, doneMarker := tp.shardFiles(shard)
+		for _, path := range []string{doneMarker, checkpointPath} {
+			if _, err := os.Stat(path); err != nil {
+				continue
+			}
+			cp, err := loadCheckpoint(path)
+			if err != nil {
+				return nil, &ShardError{Shard: shard, Err: err}
+			}
+			out = append(out, cp)
+			break
+		}
+	}
+
+	return out, nil
+}
+
+// TraverseStateTrie hands the shards to the workers, returning
+// once all of them are traversed, or the pool is stopped.
+// If a shard fails, the pool is stopped, returning a ShardError
+// with its error as the cause.
+func (tp *TriePool) TraverseStateTrie() error {
+	_l := metrics.StartLogDiff("traverse-state-trie-pool")
+	defer metrics.StopLogDiff("traverse-state-trie-pool", _l)
+
+	shards := make(chan string, len(tp.shards))
+	for _, shard := range tp.shards {
+		shards <- shard
+	}
+	close(shards)
+
+	var (
+		wg       sync.WaitGroup
+		finished int32
+		errOnce  sync.Once
+		firstErr error
+	)
+	for w := 0; w < tp.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for shard := range shards {
+				if tp.Interrupted() {
+					return
+				}
+				done, err := tp.traverseShard(shard)
+				if err != nil {
+					// The rest of the shards are stopped, to be resumed
+					errOnce.Do(func() {
+						firstErr = &ShardError{Shard: shard, Err: err}
+						tp.Stop()
+					})
+					return
+				}
+				if done {
+					fmt.Printf("Shard %s finished (%d/%d)\n",
+						shard, atomic.AddInt32(&finished, 1), len(tp.shards))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if !tp.Interrupted() {
+		atomic.StoreInt32(&tp.finished, 1)
+	}
+
+	return firstErr
+}
+
+// traverseShard traverses the given shard with a TrieStack of its own,
+// telling whether it was finished. The last checkpoint of every finished
+// shard is left as its marker, so it is not traversed again when resuming.
+func (tp *TriePool) traverseShard(shard string) (bool, error) {
+	// A shard finished before we resumed only adds its counts
+	shardDir, checkpointPath, doneMarker := tp.shardFiles(shard)
+	if _, err := os.Stat(doneMarker); err == nil {
+		cp, err := loadCheckpoint(doneMarker)
+		if err != nil {
+			return false, err
+		}
+		addCounters(cp)
+		return true, nil
+	}
+
+	cfg := tp.cfg
+	cfg.Nibble = shard
+	cfg.StackDir = shardDir
+	cfg.shard = true
+
+	// Only the shards with a checkpoint have something to resume
+	if _, err := os.Stat(checkpointPath); err != nil {
+		cfg.Resume = false
+	}
+
+	ts, err := NewTrieStack(tp.db, &cfg)
+	if err != nil {
+		return false, err
+	}
+	defer ts.Close()
+
+	tp.mutex.Lock()
+	tp.running[shard] = ts
+	tp.mutex.Unlock()
+
+	// We could have been stopped while opening the stack
+	if tp.Interrupted() {
+		ts.Stop()
+	}
+
+	err = ts.TraverseStateTrie()
+
+	tp.mutex.Lock()
+	delete(tp.running, shard)
+	tp.mutex.Unlock()
+
+	if err != nil || ts.Interrupted() {
+		return false, err
+	}
+
+	// The checkpoint is removed along with the stack on Close()
+	err = os.Rename(checkpointPath, doneMarker)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Stop makes every worker return after their current iteration,
+// saving the checkpoints of their shards to resume them.
+func (tp *TriePool) Stop() {
+	atomic.StoreInt32(&tp.stopped, 1)
+
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+	for _, ts := range tp.running {
+		ts.Stop()
+	}
+}
+
+// Interrupted tells whether Stop() was called.
+func (tp *TriePool) Interrupted() bool {
+	return atomic.LoadInt32(&tp.stopped) == 1
+}
+
+// Close removes the stacks of the shards if the traversal
+// finished, and releases the stack directory.
+func (tp *TriePool) Close() {
+	if atomic.LoadInt32(&tp.finished) == 1 {
+		os.RemoveAll(tp.shardsDir)
+	}
+	releaseStackDir(tp.lock)
+}
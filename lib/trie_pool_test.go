@@ -0,0 +1,171 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	metrics "github.com/ipfs/go-ipld-eth-import/metrics"
+)
+
+// stopVisitor stops the given pool after visiting the given
+// number of accounts, as Ctrl-C would.
+type stopVisitor struct {
+	BaseVisitor
+	tp   *TriePool
+	left int32
+}
+
+func (sv *stopVisitor) OnAccount(account *Account) error {
+	if atomic.AddInt32(&sv.left, -1) == 0 {
+		sv.tp.Stop()
+	}
+	return nil
+}
+
+// poolCounters are the counters checked against the ones of a single stack.
+var poolCounters = []string{
+	"traverse-state-accounts",
+	"traverse-state-trie-leaves",
+	"traverse-state-storage-slots",
+}
+
+// countersSince returns what was added to the poolCounters since before.
+func countersSince(before map[string]int) map[string]int {
+	out := make(map[string]int)
+	for _, key := range poolCounters {
+		out[key] = metrics.GetCounter(key) - before[key]
+	}
+	return out
+}
+
+func TestResumePoolCounters(t *testing.T) {
+	db, cleanDB := newFixtureDB(t, 400)
+	defer cleanDB()
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	defer func(interval int) { checkpointInterval = interval }(checkpointInterval)
+	checkpointInterval = 10
+
+	// The counts of a single stack
+	before := countersSince(nil)
+	cfg := fixtureConfig(filepath.Join(dir, "single"), "count-all")
+	traverse(t, db, cfg)
+	want := countersSince(before)
+
+	// A pool stopped halfway, and resumed
+	cfg = fixtureConfig(filepath.Join(dir, "pool"), "")
+	cfg.StorageTries = true
+	visitor := &stopVisitor{left: 200}
+	cfg.Visitor = visitor
+	tp, err := NewTriePool(db, cfg, 4, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	visitor.tp = tp
+	if err = tp.TraverseStateTrie(); err != nil {
+		t.Fatal(err)
+	}
+	tp.Close()
+	if !tp.Interrupted() {
+		t.Fatal("the pool was not stopped")
+	}
+
+	before = countersSince(nil)
+	cfg.Visitor = BaseVisitor{}
+	cfg.Resume = true
+	tp, err = NewTriePool(db, cfg, 4, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tp.TraverseStateTrie(); err != nil {
+		t.Fatal(err)
+	}
+	tp.Close()
+	got := countersSince(before)
+
+	for _, key := range poolCounters {
+		if got[key] != want[key] {
+			t.Errorf("%s is %d, want %d", key, got[key], want[key])
+		}
+	}
+}
+
+// exportCounters are the counters of an export checked against
+// the ones of a single stack.
+var exportCounters = []string{
+	"sink-puts",
+	"traverse-state-trie-blocks",
+	"traverse-state-trie-branches",
+	"traverse-state-trie-extensions",
+	"traverse-state-trie-leaves",
+	"traverse-state-trie-embedded-nodes",
+	"traverse-state-accounts",
+}
+
+// countExport exports the state trie of the fixture into a CountSink,
+// with a pool of the given shard nibbles, or a single stack if zero,
+// returning what was added to the exportCounters, and the paths index.
+func countExport(t *testing.T, db *GethDB, dir string, shardNibbles int) (map[string]int, []string) {
+	before := make(map[string]int)
+	for _, key := range exportCounters {
+		before[key] = metrics.GetCounter(key)
+	}
+
+	cfg := fixtureConfig(dir, "state-trie")
+	cfg.Sink = NewCountSink()
+	cfg.PathsIndex = filepath.Join(dir, "paths")
+	if shardNibbles == 0 {
+		traverse(t, db, cfg)
+	} else {
+		tp, err := NewTriePool(db, cfg, 4, shardNibbles)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = tp.TraverseStateTrie(); err != nil {
+			t.Fatal(err)
+		}
+		tp.Close()
+	}
+
+	counters := make(map[string]int)
+	for _, key := range exportCounters {
+		counters[key] = metrics.GetCounter(key) - before[key]
+	}
+	paths, err := ioutil.ReadFile(cfg.PathsIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(paths)), "\n")
+	sort.Strings(lines)
+
+	return counters, lines
+}
+
+func TestPoolVisitsSharedNodesOnce(t *testing.T) {
+	db, cleanDB := newFixtureDB(t, 400)
+	defer cleanDB()
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	want, wantPaths := countExport(t, db, filepath.Join(dir, "single"), 0)
+
+	for _, shardNibbles := range []int{1, 2} {
+		got, gotPaths := countExport(t, db, filepath.Join(dir, fmt.Sprintf("pool-%d", shardNibbles)), shardNibbles)
+		for _, key := range exportCounters {
+			if got[key] != want[key] {
+				t.Errorf("%d shard nibbles: %s is %d, want %d", shardNibbles, key, got[key], want[key])
+			}
+		}
+		if !reflect.DeepEqual(gotPaths, wantPaths) {
+			t.Errorf("%d shard nibbles: the paths index has %d lines, want %d",
+				shardNibbles, len(gotPaths), len(wantPaths))
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package lib
+
+import (
+	"math/big"
+
+	metrics "github.com/ipfs/go-ipld-eth-import/metrics"
+)
+
+// Visitor is called by a traversal on everything it finds in the state
+// trie: its nodes, the accounts in its leaves, and, if the traversal goes
+// through them, the nodes and storage slots of their storage tries and
+// their EVM codes. Returning an error stops the traversal, which can be
+// resumed from the node that failed.
+// For example, a visitor embedding BaseVisitor, with an OnCode looking for a
+// given bytecode prefix, finds the contracts having it, given EVMCodes
+// is set in the TrieStackConfig.
+// The shards of a TriePool share the same visitor, so it must be safe
+// to use from several goroutines in that case.
+type Visitor interface {
+	OnBranch(node *TrieNode) error
+	OnExtension(node *TrieNode) error
+	OnLeaf(node *TrieNode) error
+	OnAccount(account *Account) error
+	OnStorageSlot(slot *StorageSlot) error
+	OnCode(code *Code) error
+}
+
+// ProblemVisitor is a Visitor told about the broken parts of the tries,
+// where the traversal would otherwise stop. The traversal goes on, leaving
+// out what is under a missing, mismatched or corrupt node. It is only
+// told about the EVM codes if the traversal goes through them.
+type ProblemVisitor interface {
+	Visitor
+
+	// OnMissingNode is called on a node which is not in the database,
+	// having a nil RLP, or whose RLP found under its key does not
+	// hash to it. It is not decoded.
+	OnMissingNode(node *TrieNode) error
+
+	// OnCorruptNode is called on a node which could not be decoded,
+	// or whose leaf holds an account or a storage slot which could
+	// not be, with the decoding error.
+	OnCorruptNode(node *TrieNode, err error) error
+
+	// OnMissingCode is called on the leaf of an account whose EVM code
+	// is not in the database, being nil, or does not hash to its hash.
+	OnMissingCode(node *TrieNode, account *Account, code []byte) error
+}
+
+// BaseVisitor does nothing on every call. Embed it in a visitor
+// to only write the methods it is interested in.
+type BaseVisitor struct{}
+
+// Static check
+var _ Visitor = BaseVisitor{}
+
+// OnBranch does nothing.
+func (BaseVisitor) OnBranch(node *TrieNode) error { return nil }
+
+// OnExtension does nothing.
+func (BaseVisitor) OnExtension(node *TrieNode) error { return nil }
+
+// OnLeaf does nothing.
+func (BaseVisitor) OnLeaf(node *TrieNode) error { return nil }
+
+// OnAccount does nothing.
+func (BaseVisitor) OnAccount(account *Account) error { return nil }
+
+// OnStorageSlot does nothing.
+func (BaseVisitor) OnStorageSlot(slot *StorageSlot) error { return nil }
+
+// OnCode does nothing.
+func (BaseVisitor) OnCode(code *Code) error { return nil }
+
+// TrieNode is a node of the state trie, or of a storage trie.
+type TrieNode struct {
+	// The keccak256 hash of the node, its key in the database.
+	// It is nil for the nodes embedded in their parents, being
+	// shorter than 32 bytes.
+	Key []byte
+
+	// The RLP of the node, and the node decoded from it
+	RLP     []byte
+	Decoded DecodedTrieNode
+
+	// The hash of the address of the account owning the
+	// storage trie of the node, nil for the state trie
+	Account []byte
+
+	// The nibbles leading to the node from the root of its trie.
+	// For a leaf, they are completed with its own nibbles, being
+	// its full key, i.e. the hash of an account or a storage slot.
+	Path []byte
+
+	// Where the traversal found the node
+	item     *stackItem
+	leafPath []byte
+}
+
+// Account is an account of the state trie.
+type Account struct {
+	AddressHash []byte
+	Nonce       uint64
+	Balance     *big.Int
+	StorageRoot []byte
+	CodeHash    []byte
+}
+
+// StorageSlot is a storage slot of an account, by the hash of the slot,
+// its key in the storage trie. The value is decoded from its RLP.
+type StorageSlot struct {
+	AddressHash []byte
+	SlotHash    []byte
+	Value       []byte
+}
+
+// Code is the EVM code of an account.
+type Code struct {
+	AddressHash []byte
+	CodeHash    []byte
+	Code        []byte
+}
+
+/*
+  The visitors of the operations of TrieStack
+*/
+
+// nodesVisitor puts the nodes of the state trie, or the ones of the
+// storage tries, into the sink of the traversal, writing their paths
+// into its paths index. The embedded ones are part of their parents.
+type nodesVisitor struct {
+	BaseVisitor
+	ts      *TrieStack
+	storage bool
+}
+
+func (v *nodesVisitor) OnBranch(node *TrieNode) error    { return v.put(node) }
+func (v *nodesVisitor) OnExtension(node *TrieNode) error { return v.put(node) }
+func (v *nodesVisitor) OnLeaf(node *TrieNode) error      { return v.put(node) }
+
+func (v *nodesVisitor) put(node *TrieNode) error {
+	if node.Key == nil || (node.Account != nil) != v.storage {
+		return nil
+	}
+
+	format := "eth-state-trie"
+	if v.storage {
+		format = "eth-storage-trie"
+	}
+	err := v.ts.sink.Put(node.Key, node.Account, node.RLP, format)
+	if err != nil {
+		return err
+	}
+
+	return v.ts.recordPath(node.item, node.leafPath)
+}
+
+// evmCodeVisitor puts the EVM codes into the sink of the traversal.
+type evmCodeVisitor struct {
+	BaseVisitor
+	ts *TrieStack
+}
+
+func (v *evmCodeVisitor) OnCode(code *Code) error {
+	return v.ts.sink.Put(code.CodeHash, nil, code.Code, "importer-ipld-raw-data")
+}
+
+// accountsVisitor writes the accounts into the snapshot of the traversal.
+type accountsVisitor struct {
+	BaseVisitor
+	ts *TrieStack
+}
+
+func (v *accountsVisitor) OnAccount(account *Account) error {
+	return v.ts.snapshot.addAccount(account)
+}
+
+// slotsVisitor writes the storage slots into the snapshot of the
+// traversal, along with the slots themselves, if geth kept their
+// preimages. It takes note of the accounts asked for that are found.
+type slotsVisitor struct {
+	BaseVisitor
+	ts *TrieStack
+}
+
+func (v *slotsVisitor) OnAccount(account *Account) error {
+	key := string(account.AddressHash)
+	if _, ok := v.ts.accounts[key]; ok {
+		v.ts.accounts[key] = true
+	}
+
+	return nil
+}
+
+func (v *slotsVisitor) OnStorageSlot(slot *StorageSlot) error {
+	preimage, err := v.ts.db.GetPreimage(slot.SlotHash)
+	if _, missing := err.(*KeyNotFoundError); missing {
+		preimage, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return v.ts.snapshot.addSlot(slot.AddressHash, slot.SlotHash, preimage, slot.Value)
+}
+
+// verifyVisitor counts the missing, mismatched and corrupt nodes and EVM
+// codes, writing them down into the verify report of the traversal.
+type verifyVisitor struct {
+	BaseVisitor
+	ts *TrieStack
+}
+
+// Static check
+var _ ProblemVisitor = (*verifyVisitor)(nil)
+
+// newVerifyVisitor returns the verifyVisitor of the given
+// traversal, adding its counters to the metrics.
+func newVerifyVisitor(ts *TrieStack) *verifyVisitor {
+	metrics.NewCounter("traverse-state-trie-missing-nodes")
+	metrics.NewCounter("traverse-state-trie-mismatched-nodes")
+	metrics.NewCounter("traverse-state-trie-corrupt-nodes")
+	metrics.NewCounter("traverse-state-missing-codes")
+	metrics.NewCounter("traverse-state-mismatched-codes")
+
+	return &verifyVisitor{ts: ts}
+}
+
+func (v *verifyVisitor) OnMissingNode(node *TrieNode) error {
+	if node.RLP == nil {
+		v.ts.incCounter("traverse-state-trie-missing-nodes")
+		return v.report("missing-node", node.Key, node.item, nil)
+	}
+
+	v.ts.incCounter("traverse-state-trie-mismatched-nodes")
+	return v.report("mismatched-node", node.Key, node.item, nil)
+}
+
+// OnCorruptNode reports an embedded node with the key of
+// the node holding it.
+func (v *verifyVisitor) OnCorruptNode(node *TrieNode, err error) error {
+	v.ts.incCounter("traverse-state-trie-corrupt-nodes")
+	return v.report("corrupt-node", node.item.key, node.item, nil)
+}
+
+func (v *verifyVisitor) OnMissingCode(node *TrieNode, account *Account, code []byte) error {
+	if code == nil {
+		v.ts.incCounter("traverse-state-missing-codes")
+		return v.report("missing-code", account.CodeHash, node.item, node.leafPath)
+	}
+
+	v.ts.incCounter("traverse-state-mismatched-codes")
+	return v.report("mismatched-code", account.CodeHash, node.item, node.leafPath)
+}
+
+// report writes down the given problem found with the given key of the
+// node into the verify report, if any. The problems are "missing-",
+// "mismatched-" or "corrupt-", followed by "node" or "code".
+func (v *verifyVisitor) report(problem string, key []byte, item *stackItem, leafPath []byte) error {
+	if v.ts.problems == nil {
+		return nil
+	}
+
+	return v.ts.problems.addProblem(problem, v.ts.currentBlock, key, item, leafPath)
+}
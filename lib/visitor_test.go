@@ -0,0 +1,145 @@
+package lib
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	common "github.com/ethereum/go-ethereum/common"
+	types "github.com/ethereum/go-ethereum/core/types"
+	crypto "github.com/ethereum/go-ethereum/crypto"
+	trie "github.com/ethereum/go-ethereum/trie"
+)
+
+// prefixVisitor finds the contracts whose EVM code starts with the given
+// prefix, as in the example of Visitor, keeping the nonces of the accounts
+// and counting the storage slots on the way.
+type prefixVisitor struct {
+	BaseVisitor
+	prefix []byte
+	found  [][]byte
+	nonces map[string]uint64
+	slots  int
+}
+
+func (pv *prefixVisitor) OnAccount(account *Account) error {
+	pv.nonces[string(account.AddressHash)] = account.Nonce
+	return nil
+}
+
+func (pv *prefixVisitor) OnStorageSlot(slot *StorageSlot) error {
+	pv.slots++
+	return nil
+}
+
+func (pv *prefixVisitor) OnCode(code *Code) error {
+	if bytes.HasPrefix(code.Code, pv.prefix) {
+		pv.found = append(pv.found, code.AddressHash)
+	}
+	return nil
+}
+
+func TestVisitor(t *testing.T) {
+	db, cleanDB := newFixtureDB(t, 400)
+	defer cleanDB()
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	// Every third account is a contract, with 1+idx%7 slots,
+	// and only the code of the contract 3 starts with 0x6003
+	nonces := make(map[string]uint64)
+	var slots int
+	for idx := 0; idx < 400; idx++ {
+		nonces[string(crypto.Keccak256(fixtureAddress(idx)))] = uint64(idx)
+		if idx%3 == 0 {
+			slots += 1 + idx%7
+		}
+	}
+	contract := crypto.Keccak256(fixtureAddress(3))
+
+	for _, tc := range []struct {
+		storageTries, evmCodes bool
+	}{
+		{false, false},
+		{true, false},
+		{false, true},
+		{true, true},
+	} {
+		pv := &prefixVisitor{prefix: []byte{0x60, 0x03}, nonces: make(map[string]uint64)}
+		cfg := fixtureConfig(dir, "")
+		cfg.Visitor = pv
+		cfg.StorageTries = tc.storageTries
+		cfg.EVMCodes = tc.evmCodes
+		traverse(t, db, cfg)
+
+		if !reflect.DeepEqual(pv.nonces, nonces) {
+			t.Fatalf("%+v: got %d accounts, want %d", tc, len(pv.nonces), len(nonces))
+		}
+		wantSlots, wantFound := 0, [][]byte(nil)
+		if tc.storageTries {
+			wantSlots = slots
+		}
+		if tc.evmCodes {
+			wantFound = [][]byte{contract}
+		}
+		if pv.slots != wantSlots {
+			t.Fatalf("%+v: got %d slots, want %d", tc, pv.slots, wantSlots)
+		}
+		if !reflect.DeepEqual(pv.found, wantFound) {
+			t.Fatalf("%+v: got the contracts %x, want %x", tc, pv.found, wantFound)
+		}
+	}
+
+	cfg := fixtureConfig(dir, "")
+	if ts, err := NewTrieStack(db, cfg); err == nil {
+		ts.Close()
+		t.Fatal("traversed with neither an operation nor a visitor")
+	}
+}
+
+func TestVisitorOfDiff(t *testing.T) {
+	// The second block changes the nonces of three accounts
+	changed := map[int]bool{10: true, 20: true, 30: true}
+	db, cleanDB := newCustomFixtureDB(t, func(w fixtureWriter, state *trie.Trie) {
+		next, _ := trie.New(common.Hash{}, nil)
+		for idx := 0; idx < 100; idx++ {
+			key := crypto.Keccak256(fixtureAddress(idx))
+			empty := common.BytesToHash(emptyCodeHash)
+			state.Update(key, fixtureAccount(uint64(idx), emptyRoot, empty))
+			nonce := uint64(idx)
+			if changed[idx] {
+				nonce += 1000
+			}
+			next.Update(key, fixtureAccount(nonce, emptyRoot, empty))
+		}
+		root, err := next.CommitTo(w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeFixtureHeader(t, w, fixtureBlock+1, &types.Header{Root: root})
+	})
+	defer cleanDB()
+	dir, cleanDir := tempDir(t)
+	defer cleanDir()
+
+	// A diff needs a block to compare with
+	pv := &prefixVisitor{nonces: make(map[string]uint64)}
+	cfg := fixtureConfig(dir, "")
+	cfg.Visitor = pv
+	cfg.Diff = true
+	if ts, err := NewTrieStack(db, cfg); err == nil {
+		ts.Close()
+		t.Fatal("diffed a single block")
+	}
+
+	// Only the changed accounts are visited
+	cfg.ToBlock = fixtureBlock + 1
+	traverse(t, db, cfg)
+	want := make(map[string]uint64)
+	for idx := range changed {
+		want[string(crypto.Keccak256(fixtureAddress(idx)))] = uint64(idx) + 1000
+	}
+	if !reflect.DeepEqual(pv.nonces, want) {
+		t.Fatalf("got %d accounts, want the %d changed ones", len(pv.nonces), len(want))
+	}
+}
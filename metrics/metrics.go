@@ -1,6 +1,8 @@
 package metrics
 
 import (
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,16 +15,29 @@ We'll try to keep it simple.
 // Data has all the metrics data in memory. It has counters and loggers.
 // The formers can only be incremented or decreased, while the latter
 // can used to get time differences.
+// It can be used by several goroutines at the same time, i.e. the
+// workers of a TriePool. The lock only guards the maps, which are only
+// written when a counter or a logger is added. Their values are updated
+// with atomic operations, so the workers do not wait for each other.
 type Data struct {
+	sync.RWMutex
+
 	// This is just a map of `+1` counters. You know.
 	// How many iterations? How many cases of A? etc.
-	counters map[string]int
+	counters map[string]*int64
 
 	// Loggers have two use cases:
 	// * Store time differences (with StartLogDiff / StopLogDiff)
 	//   + Useful for RPC Calls and DB Queries
 	// * Store series of values (mem / CPU / active goroutines / etc)
-	loggers map[string][]int64
+	// Only their number and their sum are kept.
+	loggers map[string]*logger
+}
+
+// logger is the number of values logged, and their sum.
+type logger struct {
+	n   int64
+	sum int64
 }
 
 // The global variable here
@@ -30,8 +45,8 @@ var data Data
 
 func init() {
 	data = Data{}
-	data.counters = make(map[string]int)
-	data.loggers = make(map[string][]int64)
+	data.counters = make(map[string]*int64)
+	data.loggers = make(map[string]*logger)
 }
 
 /*
@@ -40,85 +55,94 @@ func init() {
 
 // NewCounter returns a counter with the given key.
 func NewCounter(key string) {
+	data.Lock()
+	defer data.Unlock()
+
 	if _, ok := data.counters[key]; !ok {
-		data.counters[key] = 0
+		data.counters[key] = new(int64)
 	}
 }
 
+// counter returns the given counter, nil if it was not added.
+func counter(key string) *int64 {
+	data.RLock()
+	defer data.RUnlock()
+
+	return data.counters[key]
+}
+
 // IncCounter increments the given counter by 1.
 func IncCounter(key string) {
-	if _, ok := data.counters[key]; ok {
-		data.counters[key]++
-	}
+	AddCounter(key, 1)
 }
 
 // GetCounter returns the current value of the given counter.
 func GetCounter(key string) int {
-	if val, ok := data.counters[key]; ok {
-		return val
+	if c := counter(key); c != nil {
+		return int(atomic.LoadInt64(c))
 	}
 	return 0
 }
 
+// AddCounter adds the given value to the given counter.
+// Useful to restore the counts of a previous execution.
+func AddCounter(key string, val int) {
+	if c := counter(key); c != nil {
+		atomic.AddInt64(c, int64(val))
+	}
+}
+
 /*
   LOGGERS
 */
 
 // NewLogger returns a logger.
 func NewLogger(key string) {
+	data.Lock()
+	defer data.Unlock()
+
 	if _, ok := data.loggers[key]; !ok {
-		var slice []int64
-		data.loggers[key] = slice
+		data.loggers[key] = &logger{}
 	}
 }
 
+// getLogger returns the given logger, nil if it was not added.
+func getLogger(key string) *logger {
+	data.RLock()
+	defer data.RUnlock()
+
+	return data.loggers[key]
+}
+
 // AddLog adds an int64 value to the logger. Useful for
 // aggregations, such as the total number of bytes stored.
 func AddLog(key string, val int64) {
-	if _, ok := data.loggers[key]; ok {
-		data.loggers[key] = append(data.loggers[key], val)
+	if l := getLogger(key); l != nil {
+		atomic.AddInt64(&l.n, 1)
+		atomic.AddInt64(&l.sum, val)
 	}
 }
 
-// StartLogDiff returns the index of the value logged,
-// So you can get the time difference with it uwing StopLogDiff().
-// It will store your time value as a negative number.
-// Successive functions to get averages will ignore the negative values,
-// deeming them as "incomplete logs".
-func StartLogDiff(key string) int {
-	if _, ok := data.loggers[key]; ok {
-		data.loggers[key] = append(data.loggers[key], -1*time.Now().UnixNano())
-		return len(data.loggers[key]) - 1
-	}
-	// No key found
-	return -1
+// StartLogDiff returns the current time, so you can log the time
+// difference with it using StopLogDiff(). The logs never stopped
+// are deemed as incomplete, and left out of the averages.
+func StartLogDiff(key string) int64 {
+	return time.Now().UnixNano()
 }
 
 // StopLogDiff completed the functionality documented by StartLogDiff.
-func StopLogDiff(key string, idx int) {
-	if _, ok := data.loggers[key]; ok {
-		if len(data.loggers[key]) > idx {
-			// The value created at StartLogDiff is a negative one
-			data.loggers[key][idx] = data.loggers[key][idx] + time.Now().UnixNano()
-		}
-	}
+func StopLogDiff(key string, start int64) {
+	AddLog(key, time.Now().UnixNano()-start)
 }
 
 // GetAverageLogDiff will calculate the average of the log differences,
-// discarding the negative ones, as those will be deemed as incomplete ops.
+// discarding the incomplete ones.
 func GetAverageLogDiff(key string) (int, int64, float64) {
-	if _, ok := data.loggers[key]; ok {
-		n := 0
-		sum := int64(0)
-
-		for _, v := range data.loggers[key] {
-			if v >= 0 {
-				sum += v
-				n++
-			}
-		}
-
-		return n, sum, float64(sum) / float64(n)
+	if l := getLogger(key); l != nil {
+		n := atomic.LoadInt64(&l.n)
+		sum := atomic.LoadInt64(&l.sum)
+
+		return int(n), sum, float64(sum) / float64(n)
 	}
 	return 0, 0, 0
 }
@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestConcurrentMetrics(t *testing.T) {
+	NewCounter("test-counter")
+	NewLogger("test-logger")
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				IncCounter("test-counter")
+				AddLog("test-logger", 2)
+				_l := StartLogDiff("test-logger")
+				StopLogDiff("test-logger", _l)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := GetCounter("test-counter"); got != 8000 {
+		t.Errorf("the counter is %d, want 8000", got)
+	}
+	n, sum, _ := GetAverageLogDiff("test-logger")
+	if n != 16000 || sum < 16000 {
+		t.Errorf("the logger has %d values adding up to %d", n, sum)
+	}
+
+	// What was not added is not counted
+	IncCounter("test-unknown")
+	if got := GetCounter("test-unknown"); got != 0 {
+		t.Errorf("an unknown counter is %d", got)
+	}
+}
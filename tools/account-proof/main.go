@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ipfs/go-ipld-eth-import/lib"
+)
+
+/*
+
+## ACCOUNT PROOF
+
+Walks the state trie of a block from its root, down to the given account,
+and then its storage trie down to the given storage slots, if any. It
+prints the proof (EIP-1186, as eth_getProof) as JSON, with the CID of every
+trie node of it, so the nodes can be fetched from IPFS.
+
+## BUILDING IT
+
+build/convert-ipfs-deps.sh
+go build -v -o build/bin/tool-account-proof tools/account-proof/*.go
+build/un-convert-ipfs-deps.sh
+
+## EXAMPLE USAGE
+
+./build/bin/tool-account-proof \
+	--block-number 4371405 \
+	--geth-db-filepath /Users/hj/Documents/data/fast-geth/geth/chaindata \
+	--address 0xd26114cd6ee289accf82350c8d8487fedb8a0c07 \
+	--storage-keys 0x0,0x1
+
+*/
+
+func main() {
+	var (
+		fromBlock   uint64
+		toBlock     uint64
+		blockNumber uint64
+		dbFilePath  string
+		address     string
+		storageKeys string
+	)
+
+	// Command line options
+	flag.Uint64Var(&fromBlock, "from-block", 0, "Same as --block-number, along with --to-block set to the same number")
+	flag.Uint64Var(&toBlock, "to-block", 0, "Same as --block-number, along with --from-block set to the same number")
+	flag.Uint64Var(&blockNumber, "block-number", 0, "Canonical number of the block whose state to prove")
+	flag.StringVar(&dbFilePath, "geth-db-filepath", "", "Path to the Go-Ethereum Database")
+	flag.StringVar(&address, "address", "", "Address of the account to prove")
+	flag.StringVar(&storageKeys, "storage-keys", "", "Comma separated positions of the storage slots of the account to prove")
+	flag.Parse()
+
+	// Param check. A single block is given by --block-number,
+	// or by --from-block and --to-block set to the same number
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	if setFlags["from-block"] || setFlags["to-block"] {
+		if setFlags["block-number"] || fromBlock != toBlock {
+			fmt.Printf("ERROR: Only a single block is supported, given by '--block-number', or '--from-block' and '--to-block' set to the same number. Exiting")
+			os.Exit(1)
+		}
+		blockNumber = fromBlock
+	}
+	addressBytes, err := decodeHex(address)
+	if err != nil || len(addressBytes) != 20 {
+		fmt.Printf("ERROR: Param '--address' must be an address of 20 bytes. Exiting\n")
+		os.Exit(1)
+	}
+	var keys [][]byte
+	for _, storageKey := range strings.Split(storageKeys, ",") {
+		if strings.TrimSpace(storageKey) == "" {
+			continue
+		}
+		key, err := decodeHex(storageKey)
+		if err != nil || len(key) > 32 {
+			fmt.Printf("ERROR: Wrong storage key %s. Exiting\n", storageKey)
+			os.Exit(1)
+		}
+		keys = append(keys, key)
+	}
+
+	// Cold Database
+	db, err := lib.GethDBInit(dbFilePath)
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		os.Exit(1)
+	}
+	defer db.Stop()
+
+	proof, err := lib.GetProof(db, blockNumber, addressBytes, keys)
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		db.Stop()
+		os.Exit(1)
+	}
+
+	out, err := json.MarshalIndent(proof, "", "  ")
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		db.Stop()
+		os.Exit(1)
+	}
+	fmt.Println(string(out))
+}
+
+// decodeHex decodes the given hex string, with or without 0x,
+// allowing an odd number of digits (i.e. 0x0).
+func decodeHex(s string) ([]byte, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "0x")
+	if len(s)%2 == 1 {
+		s = "0" + s
+	}
+
+	return hex.DecodeString(s)
+}
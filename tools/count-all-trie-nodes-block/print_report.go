@@ -26,11 +26,14 @@ func printReport() {
 	// Iterations
 	// Count per kind of trie node
 	// Count of smart contracts
+	fmt.Printf(iterationsFmt, "Number of blocks", metrics.GetCounter("traverse-state-trie-blocks"))
 	n, _, _ = metrics.GetAverageLogDiff("traverse-state-trie-iterations")
 	fmt.Printf(iterationsFmt, "Number of iterations", n)
+	fmt.Printf(iterationsFmt, "  Skipped (already seen)", metrics.GetCounter("traverse-state-trie-skipped-nodes"))
 	fmt.Printf(iterationsFmt, "  Branches", metrics.GetCounter("traverse-state-trie-branches"))
 	fmt.Printf(iterationsFmt, "  Extensions", metrics.GetCounter("traverse-state-trie-extensions"))
 	fmt.Printf(iterationsFmt, "  Leaves", metrics.GetCounter("traverse-state-trie-leaves"))
+	fmt.Printf(iterationsFmt, "  Embedded nodes", metrics.GetCounter("traverse-state-trie-embedded-nodes"))
 	fmt.Printf(iterationsFmt, "  Smart Contracts", metrics.GetCounter("traverse-state-smart-contracts"))
 
 	fmt.Println(separatorFmt)
@@ -45,6 +48,12 @@ func printReport() {
 	_, sum, _ = metrics.GetAverageLogDiff("traverse-state-trie")
 	fmt.Printf("%-25s: %12d ms\n", "Total Time elapsed", sum/(1000*1000))
 
+	// Only when traversing with a pool of workers
+	n, sum, _ = metrics.GetAverageLogDiff("traverse-state-trie-pool")
+	if n > 0 {
+		fmt.Printf("%-25s: %12d ms\n", "Wall Time elapsed", sum/(1000*1000))
+	}
+
 	_, sum, avg = metrics.GetAverageLogDiff("new-nodes-bytes-tranferred")
 	fmt.Printf("%-25s: %12d bytes\n", "Total bytes", sum)
 	fmt.Printf("%-25s: %12.0f bytes\n", "Average per iteration", avg)
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ipfs/go-ipld-eth-import/lib"
+	"github.com/ipfs/go-ipld-eth-import/metrics"
+)
+
+/*
+
+## VERIFY A STATE TRIE IN IPFS
+
+Starts from the CID of a state root in the local IPFS repository, and walks
+the links of its state trie nodes, checking that every block is in the
+blockstore. It counts the present and missing blocks, and writes down the
+CIDs of the missing ones, so a partial import can be finished. It exits
+with an error if any is missing.
+
+## BUILDING IT
+
+build/convert-ipfs-deps.sh
+go build -v -o build/bin/tool-verify-ipfs tools/verify-ipfs/*.go
+build/un-convert-ipfs-deps.sh
+
+## EXAMPLE USAGE
+
+./build/bin/tool-verify-ipfs \
+	--ipfs-repo-path ~/.ipfs \
+	--state-root $STATE_ROOT_CID \
+	--missing /tmp/missing-cids.txt
+
+*/
+
+func main() {
+	var (
+		ipfsRepoPath string
+		stateRoot    string
+		missing      string
+	)
+
+	// Command line options
+	flag.StringVar(&ipfsRepoPath, "ipfs-repo-path", "~/.ipfs", "IPFS repository path")
+	flag.StringVar(&stateRoot, "state-root", "", "CID of the state root to start from")
+	flag.StringVar(&missing, "missing", "/tmp/missing-cids.txt", "Path to the file to write the CIDs of the missing blocks to")
+	flag.Parse()
+
+	// Param check
+	if stateRoot == "" {
+		fmt.Printf("ERROR: Param '--state-root' is needed. Exiting\n")
+		os.Exit(1)
+	}
+
+	// IPFS
+	ipfs, err := lib.InitIPFSNode(ipfsRepoPath)
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		os.Exit(1)
+	}
+
+	// Missing CIDs
+	f, err := os.Create(missing)
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		os.Exit(1)
+	}
+	w := bufio.NewWriter(f)
+
+	err = ipfs.VerifyStateTrie(stateRoot, w)
+	if ferr := w.Flush(); err == nil {
+		err = ferr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	// Print the metrics
+	printReport()
+
+	if err != nil {
+		fmt.Printf("ERROR: %v. Exiting\n", err)
+		os.Exit(1)
+	}
+	if n := metrics.GetCounter("verify-ipfs-missing-blocks"); n > 0 {
+		fmt.Printf("ERROR: %d missing blocks, written down into %s\n", n, missing)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ipfs/go-ipld-eth-import/metrics"
+)
+
+func printReport() {
+	var (
+		n   int
+		sum int64
+		avg float64
+	)
+
+	// Formatters
+	separatorFmt := "=========================================================================\n"
+	iterationsFmt := "%-25s: %12d\n"
+	loggersFmt := "%-25s: %12.0f ns  -> Total: %18d (%d)\n"
+
+	// Actual Content
+	fmt.Printf("Verification finished\n")
+
+	fmt.Println(separatorFmt)
+
+	// Count of blocks
+	fmt.Printf(iterationsFmt, "Present blocks", metrics.GetCounter("verify-ipfs-present-blocks"))
+	fmt.Printf(iterationsFmt, "Missing blocks", metrics.GetCounter("verify-ipfs-missing-blocks"))
+
+	fmt.Println(separatorFmt)
+
+	// Logger Times (quantity, average, sum)
+	n, sum, avg = metrics.GetAverageLogDiff("verify-ipfs-blocks")
+	fmt.Printf(loggersFmt, "Avg time per block", avg, sum, n)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ipfs/go-ipld-eth-import/metrics"
+)
+
+func printReport() int {
+	var (
+		n   int
+		sum int64
+		avg float64
+	)
+
+	// Formatters
+	separatorFmt := "=========================================================================\n"
+	iterationsFmt := "%-25s: %12d\n"
+	loggersFmt := "%-25s: %12.0f ns  -> Total: %18d (%d)\n"
+
+	// Actual Content
+	fmt.Printf("Traversal finished\n")
+
+	fmt.Println(separatorFmt)
+
+	// Iterations
+	// Count per kind of trie node
+	// Count of smart contracts
+	fmt.Printf(iterationsFmt, "Number of blocks", metrics.GetCounter("traverse-state-trie-blocks"))
+	n, _, _ = metrics.GetAverageLogDiff("traverse-state-trie-iterations")
+	fmt.Printf(iterationsFmt, "Number of iterations", n)
+	fmt.Printf(iterationsFmt, "  Skipped (already seen)", metrics.GetCounter("traverse-state-trie-skipped-nodes"))
+	fmt.Printf(iterationsFmt, "  Branches", metrics.GetCounter("traverse-state-trie-branches"))
+	fmt.Printf(iterationsFmt, "  Extensions", metrics.GetCounter("traverse-state-trie-extensions"))
+	fmt.Printf(iterationsFmt, "  Leaves", metrics.GetCounter("traverse-state-trie-leaves"))
+	fmt.Printf(iterationsFmt, "  Embedded nodes", metrics.GetCounter("traverse-state-trie-embedded-nodes"))
+	fmt.Printf(iterationsFmt, "  Smart Contracts", metrics.GetCounter("traverse-state-smart-contracts"))
+	fmt.Printf(iterationsFmt, "  Storage tries", metrics.GetCounter("traverse-state-storage-tries"))
+
+	fmt.Println(separatorFmt)
+
+	// Problems
+	missingNodes := metrics.GetCounter("traverse-state-trie-missing-nodes")
+	mismatchedNodes := metrics.GetCounter("traverse-state-trie-mismatched-nodes")
+	corruptNodes := metrics.GetCounter("traverse-state-trie-corrupt-nodes")
+	missingCodes := metrics.GetCounter("traverse-state-missing-codes")
+	mismatchedCodes := metrics.GetCounter("traverse-state-mismatched-codes")
+	fmt.Printf(iterationsFmt, "Missing nodes", missingNodes)
+	fmt.Printf(iterationsFmt, "Mismatched nodes", mismatchedNodes)
+	fmt.Printf(iterationsFmt, "Corrupt nodes", corruptNodes)
+	fmt.Printf(iterationsFmt, "Missing EVM codes", missingCodes)
+	fmt.Printf(iterationsFmt, "Mismatched EVM codes", mismatchedCodes)
+
+	fmt.Println(separatorFmt)
+
+	// Logger Times (quantity, average, sum)
+	n, sum, avg = metrics.GetAverageLogDiff("traverse-state-trie-iterations")
+	fmt.Printf(loggersFmt, "Avg time per iteration", avg, sum, n)
+
+	fmt.Println(separatorFmt)
+
+	// Totals
+	_, sum, _ = metrics.GetAverageLogDiff("traverse-state-trie")
+	fmt.Printf("%-25s: %12d ms\n", "Total Time elapsed", sum/(1000*1000))
+
+	// Only when traversing with a pool of workers
+	n, sum, _ = metrics.GetAverageLogDiff("traverse-state-trie-pool")
+	if n > 0 {
+		fmt.Printf("%-25s: %12d ms\n", "Wall Time elapsed", sum/(1000*1000))
+	}
+
+	_, sum, avg = metrics.GetAverageLogDiff("new-nodes-bytes-tranferred")
+	fmt.Printf("%-25s: %12d bytes\n", "Total bytes", sum)
+	fmt.Printf("%-25s: %12.0f bytes\n", "Average per iteration", avg)
+
+	return missingNodes + mismatchedNodes + corruptNodes + missingCodes + mismatchedCodes
+}